@@ -4,6 +4,7 @@ echo "Building the benchmark for the distance computation component of Hyb-Janus
 go build ./cmd/hyb_janus.go
 app=./hyb_janus
 rep=2
+seed=1 # seed of the test data, see -seed
 
 fname="hybdist_finger.csv"
 echo "Storing the finger biometric benchmark in $fname"
@@ -14,8 +15,8 @@ do
     for r in `seq 1 $rep`
     do
         echo "Run $r."
-        $app -biotype "finger" -n $N -addr $fname -ts 64  -d 256 -ctxPerTemplate 64  -slotPerCtx 1
-        $app -biotype "finger" -n $N -addr $fname -ts 640 -d 256 -ctxPerTemplate 320 -slotPerCtx 2
+        $app -seed $seed -biotype "finger" -n $N -addr $fname -ts 64  -d 256 -ctxPerTemplate 64  -slotPerCtx 1
+        $app -seed $seed -biotype "finger" -n $N -addr $fname -ts 640 -d 256 -ctxPerTemplate 320 -slotPerCtx 2
     done
 done
 
@@ -28,8 +29,8 @@ do
     for r in `seq 1 $rep`
     do
         echo "Run $r."
-        $app -biotype "iris" -n $N -addr $fname -ts 2048  -d 2 -ctxPerTemplate 512  -slotPerCtx 4
-        $app -biotype "iris" -n $N -addr $fname -ts 10240 -d 2 -ctxPerTemplate 1280 -slotPerCtx 8
+        $app -seed $seed -biotype "iris" -n $N -addr $fname -ts 2048  -d 2 -ctxPerTemplate 512  -slotPerCtx 4
+        $app -seed $seed -biotype "iris" -n $N -addr $fname -ts 10240 -d 2 -ctxPerTemplate 1280 -slotPerCtx 8
     done
 done
 
@@ -1,43 +1,191 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"math/rand"
+	"os"
 	"time"
 
 	"github.com/tuneinsight/lattigo/v4/bfv"
+	"github.com/tuneinsight/lattigo/v4/ckks"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
 	"local.com/dedup/dedup"
 )
 
 var output_addr string = "log.csv"
+var top_k int = 0
+var verify_id int = -1
+var drop_level bool = false
+var seeded bool = false
+var num_parties int = 1
+var rotate_key bool = false
+var she_scheme string = dedup.SCHEME_BFV
+var synthetic *dedup.SyntheticGenerator = nil
+var data_seed int64 = 1
+
+// Returns a new generator of the test data (templates, queries, feature weights) seeded with -seed
+// Each use (DB generation, noise estimation) has its own generator, so that the DB does not
+// depend on the other flags. The keys and the slot randomizers use crypto randomness.
+func newDataRng() *rand.Rand {
+	return rand.New(rand.NewSource(data_seed))
+}
+
+// Noise budget (bits) kept when dropping the output ciphertexts before the transfer
+const DROP_LEVEL_MARGIN = 2
+
+// Reports a mismatch between the decrypted results and the plaintext ground truth and exits
+// with a non-zero status, so that benchmark scripts do not record wrong results.
+func failCorrectnessCheck(format string, args ...interface{}) {
+	fmt.Printf("*******************************************************\n")
+	fmt.Printf("* CORRECTNESS CHECK FAILED: "+format+"\n", args...)
+	fmt.Printf("*******************************************************\n")
+	os.Exit(1)
+}
 
 func bioIdPerformance(bioParam *dedup.JanusParams, bfvParams bfv.Parameters) {
 	fmt.Printf("Bio setting: %v\n", bioParam.Describe())
+	fmt.Printf("Data seed: %v\n", data_seed)
 
 	// Generate the biometric provider's key
-	bpHE := &dedup.HEHandler{}
-	bpHE.KeyGen(bfvParams)
-	rsHE := bpHE.GetPublicHandler()
-	janus := dedup.Janus{
-		Params: bioParam,
-		HE:     rsHE,
+	bpHE := &dedup.HEHandler{Scheme: she_scheme}
+	var rsHE *dedup.HEHandler
+	var mbp *dedup.MultipartyBP
+	if she_scheme != dedup.SCHEME_BFV && (seeded || drop_level || num_parties > 1) {
+		fmt.Printf("-seeded, -dropLevel and -parties require the %v scheme.\n", dedup.SCHEME_BFV)
+		return
+	}
+	if num_parties > 1 {
+		// The BP role is split among several key holders, the secret key is never reconstructed
+		if seeded || drop_level || rotate_key {
+			fmt.Printf("-seeded, -dropLevel and -rotateKey require a single BP holding the secret key.\n")
+			return
+		}
+		crsSeed, err := dedup.NewSeed()
+		if err != nil {
+			fmt.Printf("CRS generation error: %v.\n", err)
+			return
+		}
+		mbp, err = dedup.NewMultipartyBP(bfvParams, bioParam, num_parties, crsSeed)
+		if err != nil {
+			reportError("Collective key generation", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Collective key generation among %v key holders.\n", num_parties)
+		bpHE = mbp.OutputHE
+		rsHE = mbp.HE
+	} else {
+		// Only the rotation keys used by the identification are generated and sent to the RS
+		if err := bpHE.KeyGenForJanus(bfvParams, bioParam); err != nil {
+			reportError("Key generation", err)
+			return
+		}
+		rsHE = bpHE.GetPublicHandler()
+	}
+	rtks, _ := rsHE.EvalKey.Rtks.MarshalBinary()
+	fmt.Printf("Rotation keys: %v Galois keys (%v Bytes)\n", len(rsHE.EvalKey.Rtks.Keys), len(rtks))
+	if seeded {
+		// The BP sends compact (seeded) evaluation keys to the RS
+		var err error
+		rsHE, err = seededPublicHandler(bpHE, bioParam.GaloisElements(bfvParams), bfvParams)
+		if err != nil {
+			fmt.Printf("Seeded evaluation key error: %v.\n", err)
+			return
+		}
+	}
+	janus, err := dedup.NewJanus(bioParam, rsHE)
+	if err != nil {
+		reportError("Parameter validation", err)
+		return
+	}
+
+	// The BP estimates (once, with its key) the lowest level at which the distances still
+	// decrypt correctly and publishes it to the RS.
+	transferLevel := bfvParams.MaxLevel()
+	if drop_level {
+		var err error
+		transferLevel, err = dedup.EstimateTransferLevel(newDataRng(), bioParam, bfvParams, DROP_LEVEL_MARGIN)
+		if err != nil {
+			reportError("Transfer level estimation", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Dropping the encrypted distances to level %v (max level %v) before the transfer.\n", transferLevel, bfvParams.MaxLevel())
 	}
 
 	// Initializing a random database
 	// In a real application, the database is stored in a file
 	start := time.Now()
-	janus.GenerateUserDB()
-	query := janus.GenerateMatchingQuery(2)
-	err := janus.EncryptDatabase()
+	query, err := generateData(janus)
 	if err != nil {
-		fmt.Printf("DB encryption error: %v.\n", err)
+		fmt.Printf("Synthetic data generation error: %v.\n", err)
+		return
+	}
+	if seeded {
+		err = seededDBUpload(janus, bpHE, bfvParams)
+	} else {
+		err = janus.EncryptDatabase()
+	}
+	if err != nil {
+		reportError("DB encryption", err)
 		return
 	}
 	initEnd := time.Now()
 
+	if rotate_key {
+		// The BP rotates its key and the RS key switches the stored DB to the new key
+		rot, err := bpHE.RotateKey(bioParam)
+		if err != nil {
+			fmt.Printf("Key rotation error: %v.\n", err)
+			return
+		}
+		if err := janus.RotateDBKey(rot, bpHE.GetPublicHandler()); err != nil {
+			fmt.Printf("DB key rotation error: %v.\n", err)
+			return
+		}
+		rsHE = janus.HE
+		rotateEnd := time.Now()
+		fmt.Printf("Key rotation from epoch %v to %v: DB key switched in %v\n", rot.FromEpoch, rot.ToEpoch, rotateEnd.Sub(initEnd))
+		initEnd = rotateEnd
+	}
+
+	if verify_id >= 0 {
+		encVerify, err := janus.Verify(verify_id, query)
+		if err != nil {
+			fmt.Printf("Verification error: %v.\n", err)
+			return
+		}
+		verifyRsEnd := time.Now()
+		if mbp != nil {
+			encVerify = mbp.CollectiveDecrypt([]*rlwe.Ciphertext{encVerify})[0]
+		}
+		score := dedup.DecodeScores(bioParam.BioType, []uint64{dedup.BPprocessVerifyReq(encVerify, bpHE, bioParam, verify_id)}, bpHE.Params.T())[0]
+		verifyBpEnd := time.Now()
+		groundTruth := janus.VerifyGroundTruth(verify_id, query)
+		fmt.Printf("Verification of user %v:\n", verify_id)
+		fmt.Printf("    Score: %v (ground truth %v)\n", score, groundTruth)
+		fmt.Printf("    RS cost: %v, BP cost: %v\n", verifyRsEnd.Sub(initEnd), verifyBpEnd.Sub(verifyRsEnd))
+		if score != groundTruth {
+			failCorrectnessCheck("verification score %v of user %v, expected %v", score, verify_id, groundTruth)
+		}
+		initEnd = time.Now()
+	}
+
 	// The registration stations computation:
 	// Compute the distance between the query and each template in the database
-	encDistance := janus.Identification(query)
+	encDistance, err := janus.Identification(query)
+	if err != nil {
+		reportError("Identification", err)
+		return
+	}
+	fullTransfer := 0
+	for _, ctx := range encDistance {
+		fullTransfer += ctx.MarshalBinarySize()
+	}
+	if err := dedup.DropLevel(rsHE, encDistance, transferLevel); err != nil {
+		reportError("Modulus switching", err)
+		return
+	}
 	data, err := dedup.MarshalCtxArray(encDistance)
 	if err != nil {
 		fmt.Printf("Marshal encrypted distance error: %v.\n", err)
@@ -58,21 +206,43 @@ func bioIdPerformance(bioParam *dedup.JanusParams, bfvParams bfv.Parameters) {
 		fmt.Printf("UnMarshal encrypted distance error: %v.\n", err)
 		return
 	}
-	answer := dedup.BPprocessIdReq(encDistance, bpHE, janus.Params.SlotsPerCtx)
-	answer = answer[:janus.Params.DbSize]
+	if mbp != nil {
+		encDistance = mbp.CollectiveDecrypt(encDistance)
+	}
+	answer, err := dedup.BPprocessJanusIdReq(encDistance, bpHE, janus.Params)
+	if err != nil {
+		reportError("BP decryption", err)
+		os.Exit(1)
+	}
 	bpTimeEnd := time.Now()
 
+	if top_k > 0 {
+		candidates := dedup.TopKCandidates(dedup.DecodeScores(bioParam.BioType, answer, bpHE.Params.T()), top_k)
+		groundTruth := janus.TopKGroundTruth(query, top_k)
+		fmt.Printf("Top-%v candidates (userID, score):\n", top_k)
+		fmt.Printf("    Answer:       %v\n", candidates)
+		fmt.Printf("    Ground truth: %v\n", groundTruth)
+		if fmt.Sprint(candidates) != fmt.Sprint(groundTruth) {
+			failCorrectnessCheck("top-%v candidates do not match the ground truth", top_k)
+		}
+	}
+
 	// Compute and compare against ground truth
 	plainComputation := janus.IdentificationGroundTruth(query)
-	if bioParam.BioType == "iris" {
+	modality, _ := dedup.LookupModality(bioParam.BioType)
+	if modality.SignedScore() {
 		fmt.Printf("Answer:\n    A negative score (values larger than %v) shows a match.\n", rsHE.Params.T()/2)
 		fmt.Printf("    Score:    %v ... %v (%v)\n", answer[:10], answer[len(answer)-10:], len(answer))
-	} else if bioParam.BioType == "finger" {
+	} else {
 		fmt.Printf("Answer:\n    Computed distance between query and each template.\n")
 		fmt.Printf("    Distance: %v ... %v (%v)\n", answer[:10], answer[len(answer)-10:], len(answer))
 	}
 	fmt.Printf("Ground truth:\n")
-	fmt.Printf("    Distance: %v ... %v \n", plainComputation[:10], plainComputation[len(plainComputation)-10:])
+	fmt.Printf("    Score:    %v ... %v \n", plainComputation[:10], plainComputation[len(plainComputation)-10:])
+	if err := dedup.CheckAnswer(answer, plainComputation, bpHE.Params.T()); err != nil {
+		failCorrectnessCheck("%v", err)
+	}
+	fmt.Printf("Correctness check: the %v decrypted scores match the ground truth.\n", len(plainComputation))
 
 	// Print performance measures
 	fmt.Printf("*******************************************************\n")
@@ -83,27 +253,441 @@ func bioIdPerformance(bioParam *dedup.JanusParams, bfvParams bfv.Parameters) {
 	fmt.Printf("*******************************************************\n")
 	fmt.Printf("* Transfer (Bytes): %v\n", transfer)
 	fmt.Printf("* Transfer (MB): %v\n", transfer/1024/1024)
+	if drop_level {
+		fmt.Printf("* Transfer without level dropping (Bytes): %v (saved %.1f%%)\n", fullTransfer, 100*float64(fullTransfer-transfer)/float64(fullTransfer))
+	}
 	fmt.Printf("*******************************************************\n")
 
 	// Write performance measures to a file
 	rs_comp := rsTimeEnd.Sub(initEnd)
 	bp_comp := bpTimeEnd.Sub(rsTimeEnd)
 	log := fmt.Sprintf("%v,%v,%v,%v,%v\n", janus.Params.DbSize, janus.Params.TemplateSize, rs_comp.Milliseconds(), bp_comp.Milliseconds(), transfer)
-	dedup.AppendLine(output_addr, log)
+	if err := dedup.AppendLine(output_addr, log); err != nil {
+		fmt.Printf("Performance log error: %v.\n", err)
+	}
+}
+
+// Prints the error of $stage with a hint on the flags to change
+func reportError(stage string, err error) {
+	fmt.Printf("%v error: %v.\n", stage, err)
+	if errors.Is(err, dedup.ErrPacking) {
+		fmt.Printf("The templates do not fit in the strips, check -ctxPerTemplate and -slotPerCtx (TS <= ctxPerTemplate*slotPerCtx) or use -autoStrip.\n")
+	} else if errors.Is(err, dedup.ErrParamMismatch) {
+		fmt.Printf("Check the biometric, strip and HE parameters (-autoParams and -autoStrip select consistent HE and strip parameters).\n")
+	}
+}
+
+// Generates the user database and a query matching the user 2, with the realistic synthetic
+// generator if -synthetic is set
+func generateData(janus *dedup.Janus) (*dedup.PlainBio, error) {
+	if synthetic == nil {
+		rng := newDataRng()
+		janus.GenerateUserDB(rng)
+		return janus.GenerateMatchingQuery(rng, 2), nil
+	}
+	if err := janus.GenerateSyntheticUserDB(synthetic); err != nil {
+		return nil, err
+	}
+	return janus.GenerateSyntheticQuery(synthetic, 2)
+}
+
+// Identification of real-valued embeddings with CKKS (-biotype embedding)
+func embeddingIdPerformance(bioParam *dedup.JanusParams, metric string) {
+	ckksParams, err := ckks.NewParametersFromLiteral(dedup.DefaultCKKSParams)
+	if err != nil {
+		fmt.Printf("CKKS parameters error: %v.\n", err)
+		return
+	}
+	fmt.Printf("CKKS parameters: N=%v, slots=%v, Q = %v bits, scale 2^%v\n", ckksParams.N(), ckksParams.Slots(), ckksParams.LogQ(), dedup.DefaultCKKSParams.LogScale)
+	bioParam.Nbfv = ckksParams.Slots()
+	fmt.Printf("Bio setting: %v", bioParam.Describe())
+	fmt.Printf("Metric: %v\n", metric)
+	fmt.Printf("Data seed: %v\n", data_seed)
+
+	// Generate the biometric provider's key
+	bpHE := &dedup.CKKSHandler{}
+	bpHE.KeyGen(ckksParams, bioParam)
+	janus := dedup.FloatJanus{
+		Params: bioParam,
+		HE:     bpHE.GetPublicHandler(),
+		Metric: metric,
+	}
+
+	start := time.Now()
+	rng := newDataRng()
+	janus.GenerateUserDB(rng)
+	query := janus.GenerateMatchingQuery(rng, 2)
+	if err := janus.EncryptDatabase(); err != nil {
+		reportError("DB encryption", err)
+		return
+	}
+	initEnd := time.Now()
+
+	encScores, err := janus.Identification(query)
+	if err != nil {
+		reportError("Identification", err)
+		return
+	}
+	rsTimeEnd := time.Now()
+	transfer := 0
+	for _, ctx := range encScores {
+		transfer += ctx.MarshalBinarySize()
+	}
+
+	answer := dedup.BPprocessFloatIdReq(encScores, bpHE, bioParam)
+	bpTimeEnd := time.Now()
+
+	groundTruth, err := janus.IdentificationGroundTruth(query)
+	if err != nil {
+		fmt.Printf("Ground truth error: %v.\n", err)
+		return
+	}
+	fmt.Printf("Answer:\n    Score:    %.4f ... (%v)\n", answer[:10], len(answer))
+	fmt.Printf("Ground truth:\n    Score:    %.4f ...\n", groundTruth[:10])
+	maxErr := dedup.MaxFloatError(answer, groundTruth)
+	fmt.Printf("    Max absolute error: %.2e\n", maxErr)
+	if maxErr > dedup.FLOAT_SCORE_TOLERANCE {
+		failCorrectnessCheck("max absolute error %.2e of the CKKS scores exceeds %.0e", maxErr, dedup.FLOAT_SCORE_TOLERANCE)
+	}
+
+	fmt.Printf("*******************************************************\n")
+	fmt.Printf("* Performace:\n")
+	fmt.Printf("* Initialization (gen and encrypt DB) %v\n", initEnd.Sub(start))
+	fmt.Printf("* RS cost (Compute encrypted score): %v\n", rsTimeEnd.Sub(initEnd))
+	fmt.Printf("* BP cost (Decrypt ): %v\n", bpTimeEnd.Sub(rsTimeEnd))
+	fmt.Printf("*******************************************************\n")
+	fmt.Printf("* Transfer (Bytes): %v\n", transfer)
+	fmt.Printf("*******************************************************\n")
+
+	log := fmt.Sprintf("%v,%v,%v,%v,%v\n", bioParam.DbSize, bioParam.TemplateSize, rsTimeEnd.Sub(initEnd).Milliseconds(), bpTimeEnd.Sub(rsTimeEnd).Milliseconds(), transfer)
+	if err := dedup.AppendLine(output_addr, log); err != nil {
+		fmt.Printf("Performance log error: %v.\n", err)
+	}
+}
+
+// Generates seeded evaluation keys with the BP key, and returns the RS handler built from
+// their compact serialization.
+func seededPublicHandler(bpHE *dedup.HEHandler, galEls []uint64, bfvParams bfv.Parameters) (*dedup.HEHandler, error) {
+	seed, err := dedup.NewSeed()
+	if err != nil {
+		return nil, err
+	}
+	sevk, err := dedup.GenSeededEvaluationKey(bfvParams, bpHE.SecretKey, seed, galEls)
+	if err != nil {
+		return nil, err
+	}
+	data, err := sevk.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	rlk, err := sevk.Rlk.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	rtks, err := sevk.Rtks.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Evaluation keys (Bytes): %v seeded, %v full\n", len(data), len(rlk)+len(rtks))
+
+	evk, err := dedup.UnMarshalSeededEvaluationKey(bfvParams, data)
+	if err != nil {
+		return nil, err
+	}
+	if !evk.Rlk.Equals(sevk.Rlk) || !evk.Rtks.Equals(sevk.Rtks) {
+		return nil, fmt.Errorf("seeded evaluation key round-trip mismatch")
+	}
+	rsHE := &dedup.HEHandler{}
+	if err := rsHE.SetKeys(bfvParams, nil, bpHE.PublicKey, evk.EvaluationKey); err != nil {
+		return nil, err
+	}
+	return rsHE, nil
+}
+
+// Encrypts the DB with a seeded symmetric encryptor (enrollment device holding the key),
+// and loads it on the RS from its compact serialization.
+func seededDBUpload(janus *dedup.Janus, bpHE *dedup.HEHandler, bfvParams bfv.Parameters) error {
+	seed, err := dedup.NewSeed()
+	if err != nil {
+		return err
+	}
+	enc, err := dedup.NewSeededEncryptor(bfvParams, bpHE.SecretKey, seed)
+	if err != nil {
+		return err
+	}
+	if err := janus.EncryptDatabaseSeeded(enc); err != nil {
+		return err
+	}
+	data, err := janus.MarshalSeededDatabase()
+	if err != nil {
+		return err
+	}
+
+	// the seeded serialization must decode to the same ciphertexts
+	ctxs, err := dedup.UnMarshalSeededCtxArray(bfvParams, data)
+	if err != nil {
+		return err
+	}
+	full, err := dedup.MarshalCtxArray(ctxs)
+	if err != nil {
+		return err
+	}
+	if err := janus.LoadSeededDatabase(data); err != nil {
+		return err
+	}
+	reloaded, err := janus.MarshalSeededDatabase()
+	if err != nil {
+		return err
+	}
+	seededSize, fullSize := 0, 0
+	for i := range data {
+		if string(data[i]) != string(reloaded[i]) {
+			return fmt.Errorf("seeded DB round-trip mismatch")
+		}
+		seededSize += len(data[i])
+	}
+	for _, v := range full {
+		fullSize += len(v)
+	}
+	fmt.Printf("Encrypted DB upload (Bytes): %v seeded, %v full\n", seededSize, fullSize)
+	return nil
 }
 
 func main() {
 
 	db_size := flag.Int("n", 100, "Number of users in the membership database.")
 	sensorTS := flag.Int("ts", 64, "The size of the biometric template.")
-	sensorD := flag.Int64("d", 256, "The domain of biometric values.")
-	bioType := flag.String("biotype", "finger", "The biometric mode from ['finger', 'iris'].")
-	ctxPerBatch := flag.Int("ctxPerTemplate", 16, "Strip parameter: number of ciphertexts in strip batching. (Following must hold TS == ctxPerTemplate*slotPerCtx)")
-	slotPerCtx := flag.Int("slotPerCtx", 4, "Strip parameter: number of batched elements in strip batching. (Following must hold TS == ctxPerTemplate*slotPerCtx)")
+	sensorD := flag.Int64("d", 256, "The domain of biometric values (face: embeddings are quantized to integers in (-d, d)).")
+	bioType := flag.String("biotype", "finger", "The biometric mode from ['finger', 'iris', 'face', 'embedding'] (face: quantized normalized embeddings of dimension ts, e.g., 128 or 512; embedding: real-valued feature vectors of dimension ts, encrypted with CKKS).")
+	ctxPerBatch := flag.Int("ctxPerTemplate", 16, "Strip parameter: number of ciphertexts in strip batching. (Following must hold TS <= ctxPerTemplate*slotPerCtx, templates are zero padded; 0 selects ceil(TS/slotPerCtx))")
+	slotPerCtx := flag.Int("slotPerCtx", 4, "Strip parameter: number of batched elements in strip batching. (Following must hold TS <= ctxPerTemplate*slotPerCtx, templates are zero padded)")
 	addr := flag.String("addr", "log.csv", "The address for storing the output file.")
-	flag.Parse()
+	topK := flag.Int("topk", 0, "Report the k closest users in the database (0 disables top-k identification).")
+	autoParams := flag.Bool("autoParams", false, "Select the BFV parameters (ring, modulus and plaintext modulus T) automatically from the sensor parameters.")
+	pq := flag.Bool("pq", true, "Require 128-bit post-quantum security with -autoParams (otherwise 128-bit classical security).")
+	autoStrip := flag.Bool("autoStrip", false, "Select the strip parameters (ctxPerTemplate, slotPerCtx) automatically using the default cost model.")
+	packResults := flag.Bool("packResults", false, "Merge the sparse encrypted distances into fewer ciphertexts before the transfer (requires more noise budget).")
+	distance := flag.String("distance", dedup.DIST_EUCLIDEAN, "Distance of -biotype finger: euclidean, weighted (random per-feature weights) or l1 (requires d <= 16). weighted and l1 require -autoParams.")
+	dropLevel := flag.Bool("dropLevel", false, "Drop the encrypted distances to the lowest level that still decrypts correctly before the transfer.")
+	parties := flag.Int("parties", 1, "Number of key holders sharing the BP role (collective key generation and decryption).")
+	rotateKey := flag.Bool("rotateKey", false, "Rotate the BP key after encrypting the DB and key switch the encrypted DB to the new key.")
+	scheme := flag.String("scheme", dedup.SCHEME_BFV, "SHE scheme used by the RS and the BP: bfv or bgv.")
+	seededFlag := flag.Bool("seeded", false, "Use seeded (compressed) serialization for the evaluation keys and the encrypted DB upload (symmetric encryption by the key holder).")
+	mask := flag.Bool("mask", false, "Finger templates have quality masks: only the features valid in both templates contribute to the distance.")
+	metric := flag.String("metric", dedup.FLOAT_METRIC_COSINE, "Score of -biotype embedding: cosine or euclidean.")
+	seed := flag.Int64("seed", 1, "Seed of the generator of the test data (DB, query, feature weights), the same seed gives the same data. The keys and the encryption use crypto randomness.")
+	syntheticFlag := flag.Bool("synthetic", false, "Generate the database and the query with the realistic synthetic generator (correlated iris bits with occlusions, FingerCode-like finger features, noisy face embeddings).")
+	verifyID := flag.Int("verify", -1, "Run a 1:1 verification of the query against this user id (-1 disables verification).")
+	setupPath := flag.String("setup", "janus_setup.json", "Lifecycle: biometric and HE parameters written by keygen.")
+	skPath := flag.String("sk", "janus_bp.sk", "Lifecycle: secret key of the BP written by keygen.")
+	keysPath := flag.String("keys", "janus_public.keys", "Lifecycle: public and evaluation keys written by keygen.")
+	templatesPath := flag.String("templates", "janus_templates.db", "Lifecycle: plaintext DB templates written by enroll.")
+	encDBPath := flag.String("encdb", "janus_encrypted.db", "Lifecycle: encrypted DB written by encrypt-db.")
+	queryPath := flag.String("query", "janus_query.tpl", "Lifecycle: query template (identification request) written by enroll -probe.")
+	responsePath := flag.String("response", "janus_response.bin", "Lifecycle: encrypted scores (identification response) written by identify.")
+	probe := flag.Int("probe", -1, "enroll: write a new sample of this enrolled user to -query (-1 disables).")
+
+	// Subcommands:
+	//   (none)  benchmark the identification and log the performance measures
+	//   noise   report the remaining noise budget of the identification outputs
+	//   schemes compare the latency and ciphertext sizes of BFV and BGV
+	//   scores  report the genuine and impostor score distributions of the synthetic generator
+	//   keygen, enroll, encrypt-db, identify, decrypt, inspect: the lifecycle steps on files, see lifecycle.go
+	command, args := "bench", os.Args[1:]
+	if len(args) > 0 && (args[0] == "noise" || args[0] == "schemes" || args[0] == "scores" || isLifecycleCommand(args[0])) {
+		command, args = args[0], args[1:]
+	}
+	flag.CommandLine.Parse(args)
 	output_addr = *addr
+	top_k = *topK
+	verify_id = *verifyID
+	drop_level = *dropLevel
+	seeded = *seededFlag
+	data_seed = *seed
+	num_parties = *parties
+	rotate_key = *rotateKey
+	she_scheme = *scheme
+	if she_scheme != dedup.SCHEME_BFV && she_scheme != dedup.SCHEME_BGV {
+		fmt.Printf("Scheme %v not supported.\n", she_scheme)
+		return
+	}
+	files := lifecycleFiles{
+		setup:     *setupPath,
+		sk:        *skPath,
+		keys:      *keysPath,
+		templates: *templatesPath,
+		encDB:     *encDBPath,
+		query:     *queryPath,
+		response:  *responsePath,
+	}
+	if isLifecycleCommand(command) && command != "keygen" {
+		// the parameters are read from the setup
+		if err := runLifecycle(command, files, *db_size, *syntheticFlag, *probe, flag.Args()); err != nil {
+			reportError(command, err)
+			os.Exit(1)
+		}
+		return
+	}
 
+	hasMask := false
+	if *bioType != "embedding" {
+		modality, err := dedup.LookupModality(*bioType)
+		if err != nil {
+			fmt.Printf("%v (registered: %v, embedding).\n", err, dedup.ModalityNames())
+			return
+		}
+		hasMask = modality.HasMask()
+	}
+	if *mask {
+		if *bioType != "finger" {
+			fmt.Printf("-mask requires -biotype finger.\n")
+			return
+		}
+		hasMask = true
+	}
+	bioParam := &dedup.JanusParams{
+		DbSize:         *db_size,
+		TemplateSize:   *sensorTS,
+		SensorD:        *sensorD,
+		BioType:        *bioType,
+		CtxPerTemplate: *ctxPerBatch,
+		SlotsPerCtx:    *slotPerCtx,
+		SensorHasMask:  hasMask,
+		PackResults:    *packResults,
+	}
+	if *distance != dedup.DIST_EUCLIDEAN {
+		// the hand-picked parameters only support the Euclidean distance circuit
+		if *bioType != "finger" || !*autoParams {
+			fmt.Printf("-distance %v requires -biotype finger and -autoParams.\n", *distance)
+			return
+		}
+		if *distance == dedup.DIST_L1 && *sensorD > 2 && she_scheme != dedup.SCHEME_BFV {
+			fmt.Printf("-distance l1 with d > 2 requires the %v scheme.\n", dedup.SCHEME_BFV)
+			return
+		}
+		bioParam.Distance = *distance
+		if *distance == dedup.DIST_WEIGHTED_EUCLIDEAN {
+			bioParam.FeatureWeights = dedup.NewRandomFeatureWeights(newDataRng(), bioParam.TemplateSize, dedup.FEATURE_WEIGHT_MAX)
+		}
+	}
+	if bioParam.CtxPerTemplate == 0 && bioParam.SlotsPerCtx > 0 {
+		bioParam.CtxPerTemplate = (bioParam.TemplateSize + bioParam.SlotsPerCtx - 1) / bioParam.SlotsPerCtx
+	}
+	if *autoStrip {
+		// the strip geometry is not known yet, select the BFV parameters for the worst case
+		bioParam.CtxPerTemplate = 0
+	}
+
+	if *syntheticFlag || command == "scores" {
+		if *bioType == "embedding" {
+			fmt.Printf("-synthetic and scores do not support -biotype embedding.\n")
+			return
+		}
+		synthetic = dedup.NewSyntheticGenerator(newDataRng(), dedup.DefaultSyntheticConfig)
+	}
+	if command == "scores" {
+		// plaintext only, the FeatureWeights of -distance weighted are used by the scores
+		dist, err := dedup.SyntheticScoreDistribution(bioParam, synthetic)
+		if err != nil {
+			reportError("Score distribution", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Bio setting: %v\n", bioParam.Describe())
+		fmt.Print(dist.Describe())
+		return
+	}
+
+	if *bioType == "embedding" {
+		embeddingIdPerformance(bioParam, *metric)
+		return
+	}
+
+	var bfvParams bfv.Parameters
+	var err error
+	if *autoParams {
+		security := dedup.Classical128
+		if *pq {
+			security = dedup.PostQuantum128
+		}
+		if num_parties > 1 {
+			// the smudging noise of the collective decryption needs a larger noise budget
+			bfvParams, err = dedup.SelectMultipartyBFVParams(bioParam, security, num_parties)
+		} else {
+			bfvParams, err = dedup.SelectBFVParams(bioParam, security)
+		}
+		if err != nil {
+			reportError("Parameter selection", err)
+			os.Exit(1)
+		}
+	} else {
+		bfvParams, err = manualBFVParams(*bioType, *sensorTS)
+		if err != nil {
+			reportError("Parameter selection", err)
+			os.Exit(1)
+		}
+	}
+	dedup.DescribeParams(bfvParams)
+	bioParam.Nbfv = bfvParams.N()
+
+	if *autoStrip {
+		plan, err := dedup.PlanStrip(bioParam.TemplateSize, bioParam.DbSize, bioParam.Nbfv, dedup.DefaultStripCostModel, true)
+		if err != nil {
+			reportError("Strip planning", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Selected strip parameters: %v\n", plan)
+		plan.Apply(bioParam)
+	}
+	if err := bioParam.Validate(bfvParams); err != nil {
+		reportError("Parameter validation", err)
+		os.Exit(1)
+	}
+
+	if command == "keygen" {
+		if err := keygen(files, bioParam, bfvParams); err != nil {
+			reportError(command, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if command == "noise" {
+		report, err := dedup.EstimateNoiseBudget(newDataRng(), bioParam, bfvParams)
+		if err != nil {
+			reportError("Noise estimation", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Bio setting: %v\n", bioParam.Describe())
+		fmt.Print(report.Describe())
+		if report.Exhausted() {
+			fmt.Printf("The noise budget is exhausted: the outputs do not decrypt correctly, use larger parameters (e.g., -autoParams).\n")
+			os.Exit(1)
+		}
+		level, err := dedup.EstimateTransferLevel(newDataRng(), bioParam, bfvParams, DROP_LEVEL_MARGIN)
+		if err != nil {
+			reportError("Transfer level estimation", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Lowest transfer level: %v (max level %v)\n", level, bfvParams.MaxLevel())
+		return
+	}
+	if command == "schemes" {
+		fmt.Printf("Bio setting: %v\n", bioParam.Describe())
+		for _, scheme := range []string{dedup.SCHEME_BFV, dedup.SCHEME_BGV} {
+			bench, err := dedup.BenchmarkScheme(newDataRng(), bioParam, bfvParams, scheme)
+			if err != nil {
+				reportError("Scheme benchmark", err)
+				os.Exit(1)
+			}
+			fmt.Print(bench.Describe())
+		}
+		return
+	}
+	bioIdPerformance(bioParam, bfvParams)
+}
+
+// The hand-picked parameters used in the paper
+func manualBFVParams(bioType string, sensorTS int) (bfv.Parameters, error) {
 	// alternative parameters
 	// paramDef := bfv.PN12QP109
 	// paramDef := bfv.PN13QP218
@@ -115,7 +699,11 @@ func main() {
 	// set bfv parameters
 	paramDef := bfv.PN12QP101pq // Provides 128-bit post quantom security
 	paramDef.T = 4079617
-	if *bioType == "finger" && *sensorTS >= 256 {
+	if bioType == "finger" {
+		// The max distance of FingerSensor(64, 256) is 64*255^2 = 4161600 > 4079617
+		paramDef.T = 4169729
+	}
+	if bioType == "finger" && sensorTS >= 256 {
 		// Increasing the template size, increases the max distance and impacts the noise (additive)
 		// supporting larger template sizes requires either larger parameter (PN13QP218, N=8192)
 		// or if keeping N fixed to 4096, then moving to the non quantion secure version with
@@ -124,25 +712,5 @@ func main() {
 		// paramDef = bfv.PN13QP202pq // Slower, but provides 128-bit post quantom security
 		paramDef.T = 0x3ee0001
 	}
-	bfvParams, err := bfv.NewParametersFromLiteral(paramDef)
-	if err != nil {
-		panic(err)
-	}
-
-	hasMask := false
-	if *bioType == "iris" {
-		hasMask = true
-	}
-	bioParam := &dedup.JanusParams{
-		DbSize:         *db_size,
-		TemplateSize:   *sensorTS,
-		SensorD:        *sensorD,
-		BioType:        *bioType,
-		CtxPerTemplate: *ctxPerBatch,
-		SlotsPerCtx:    *slotPerCtx,
-		SensorHasMask:  hasMask,
-		Nbfv:           bfvParams.N(),
-	}
-
-	bioIdPerformance(bioParam, bfvParams)
+	return bfv.NewParametersFromLiteral(paramDef)
 }
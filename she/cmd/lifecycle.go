@@ -0,0 +1,392 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"strconv"
+
+	"github.com/tuneinsight/lattigo/v4/bfv"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+	"local.com/dedup/dedup"
+)
+
+// Lifecycle subcommands: each role runs its step separately on files
+//   keygen     (BP)  selects the parameters, writes the setup, the secret key and the public keys
+//   enroll           appends -n new templates to the plaintext DB, -probe writes a query
+//   encrypt-db       encrypts the plaintext DB with the public key
+//   identify   (RS)  computes the encrypted scores of the query (-verify: 1:1 verification)
+//   decrypt    (BP)  decrypts the response and reports the matches (-topk candidates)
+//   inspect          describes the files given as arguments
+
+var LIFECYCLE_COMMANDS = []string{"keygen", "enroll", "encrypt-db", "identify", "decrypt", "inspect"}
+
+// Number of candidates reported by decrypt without -topk
+const DEFAULT_DECRYPT_TOPK = 5
+
+// Files of the lifecycle, see the -setup, -sk, -keys, -templates, -encdb, -query and -response flags
+type lifecycleFiles struct {
+	setup     string
+	sk        string
+	keys      string
+	templates string
+	encDB     string
+	query     string
+	response  string
+}
+
+func isLifecycleCommand(command string) bool {
+	for _, c := range LIFECYCLE_COMMANDS {
+		if c == command {
+			return true
+		}
+	}
+	return false
+}
+
+// BP: generates the keys of the setup
+// The DB size of the setup is informative, the keys do not depend on it.
+func keygen(files lifecycleFiles, bio *dedup.JanusParams, params bfv.Parameters) error {
+	bpHE := &dedup.HEHandler{Scheme: she_scheme}
+	if err := bpHE.KeyGenForJanus(params, bio); err != nil {
+		return err
+	}
+	secret, public, err := bpHE.MarshalKeys()
+	if err != nil {
+		return err
+	}
+	setup := &dedup.Setup{Scheme: she_scheme, Bio: *bio, HE: params}
+	if err := setup.Write(files.setup); err != nil {
+		return err
+	}
+	if err := secret.Write(files.sk); err != nil {
+		return err
+	}
+	if err := public.Write(files.keys); err != nil {
+		return err
+	}
+	fmt.Printf("Setup written to %v, secret key to %v (keep it at the BP), public keys to %v (send them to the RS).\n",
+		files.setup, files.sk, files.keys)
+	return nil
+}
+
+// Appends $n new templates to the plaintext DB and, if $probe >= 0, writes a new sample of
+// the enrolled user $probe as the query
+// The data of each user is drawn from its own generator seeded with -seed and the user index
+// (userDataRng), so that the users do not depend on the enrollment batches. The same -seed
+// gives the same users: enroll different populations with different seeds.
+func enroll(files lifecycleFiles, n int, useSynthetic bool, probe int) error {
+	setup, err := dedup.ReadSetup(files.setup)
+	if err != nil {
+		return err
+	}
+	db := []*dedup.PlainBio{}
+	if _, err := os.Stat(files.templates); err == nil {
+		f, err := dedup.ReadJanusFile(files.templates, dedup.FILE_TEMPLATES)
+		if err != nil {
+			return err
+		}
+		if db, err = f.Templates(); err != nil {
+			return err
+		}
+	}
+
+	first := len(db)
+	for i := first; i < first+n; i++ {
+		rng := userDataRng("template", i)
+		var bio *dedup.PlainBio
+		if useSynthetic {
+			gen := dedup.NewSyntheticGenerator(rng, dedup.DefaultSyntheticConfig)
+			if bio, err = gen.NewTemplate(&setup.Bio); err != nil {
+				return err
+			}
+		} else {
+			bio = dedup.NewRandomPlainBio(rng, &setup.Bio)
+		}
+		db = append(db, bio)
+	}
+	if n > 0 {
+		f, err := dedup.NewTemplatesFile(db)
+		if err != nil {
+			return err
+		}
+		if err := f.Write(files.templates); err != nil {
+			return err
+		}
+		fmt.Printf("Enrolled users %v to %v (seed %v), %v users in %v.\n", first, first+n-1, data_seed, len(db), files.templates)
+	}
+
+	if probe >= 0 {
+		if probe >= len(db) {
+			return fmt.Errorf("-probe %v: user not in DB[%v]", probe, len(db))
+		}
+		rng := userDataRng("probe", probe)
+		var query *dedup.PlainBio
+		if useSynthetic {
+			gen := dedup.NewSyntheticGenerator(rng, dedup.DefaultSyntheticConfig)
+			if query, err = gen.NewGenuineSample(&setup.Bio, db[probe]); err != nil {
+				return err
+			}
+		} else {
+			query = db[probe].CreateFakeMatch(rng, 0.9)
+		}
+		f, err := dedup.NewTemplatesFile([]*dedup.PlainBio{query})
+		if err != nil {
+			return err
+		}
+		if err := f.Write(files.query); err != nil {
+			return err
+		}
+		fmt.Printf("Query matching user %v written to %v.\n", probe, files.query)
+	}
+	return nil
+}
+
+// Loads the setup and the handler, with the secret key if $withSecret (BP)
+func loadHandler(files lifecycleFiles, withSecret bool) (*dedup.Setup, *dedup.HEHandler, error) {
+	setup, err := dedup.ReadSetup(files.setup)
+	if err != nil {
+		return nil, nil, err
+	}
+	public, err := dedup.ReadJanusFile(files.keys, dedup.FILE_PUBLIC_KEYS)
+	if err != nil {
+		return nil, nil, err
+	}
+	var secret *dedup.JanusFile
+	if withSecret {
+		if secret, err = dedup.ReadJanusFile(files.sk, dedup.FILE_SECRET_KEY); err != nil {
+			return nil, nil, err
+		}
+	}
+	he, err := dedup.LoadHandler(setup, public, secret)
+	if err != nil {
+		return nil, nil, err
+	}
+	return setup, he, nil
+}
+
+// Number of users recorded in the encrypted DB or response file
+func fileUsers(f *dedup.JanusFile) (int, error) {
+	users, err := strconv.Atoi(f.Meta[dedup.META_USERS])
+	if err != nil {
+		return 0, fmt.Errorf("%v file without number of users", f.Kind)
+	}
+	return users, nil
+}
+
+// Encrypts the plaintext DB with the public key
+func encryptDB(files lifecycleFiles) error {
+	setup, he, err := loadHandler(files, false)
+	if err != nil {
+		return err
+	}
+	f, err := dedup.ReadJanusFile(files.templates, dedup.FILE_TEMPLATES)
+	if err != nil {
+		return err
+	}
+	db, err := f.Templates()
+	if err != nil {
+		return err
+	}
+	bio := setup.Bio
+	bio.DbSize = len(db)
+	janus, err := dedup.NewJanus(&bio, he)
+	if err != nil {
+		return err
+	}
+	if err := janus.SetUserDB(db); err != nil {
+		return err
+	}
+	if err := janus.EncryptDatabase(); err != nil {
+		return err
+	}
+	encDB, err := janus.MarshalDatabase()
+	if err != nil {
+		return err
+	}
+	if err := encDB.Write(files.encDB); err != nil {
+		return err
+	}
+	fmt.Printf("Encrypted DB[%v] written to %v (%v ciphertexts).\n", len(db), files.encDB, len(encDB.Items))
+	return nil
+}
+
+// RS: computes the encrypted scores of the query against the encrypted DB
+func identify(files lifecycleFiles, verifyID int) error {
+	setup, he, err := loadHandler(files, false)
+	if err != nil {
+		return err
+	}
+	encDB, err := dedup.ReadJanusFile(files.encDB, dedup.FILE_ENCRYPTED_DB)
+	if err != nil {
+		return err
+	}
+	bio := setup.Bio
+	if bio.DbSize, err = fileUsers(encDB); err != nil {
+		return err
+	}
+	janus, err := dedup.NewJanus(&bio, he)
+	if err != nil {
+		return err
+	}
+	if err := janus.LoadDatabase(encDB); err != nil {
+		return err
+	}
+	f, err := dedup.ReadJanusFile(files.query, dedup.FILE_TEMPLATES)
+	if err != nil {
+		return err
+	}
+	queries, err := f.Templates()
+	if err != nil {
+		return err
+	}
+	if len(queries) != 1 {
+		return fmt.Errorf("%v holds %v templates, expected a single query", files.query, len(queries))
+	}
+	if err := bio.CheckTemplates(queries); err != nil {
+		return err
+	}
+
+	var encScores []*rlwe.Ciphertext
+	if verifyID >= 0 {
+		encScore, err := janus.Verify(verifyID, queries[0])
+		if err != nil {
+			return err
+		}
+		encScores = []*rlwe.Ciphertext{encScore}
+	} else if encScores, err = janus.Identification(queries[0]); err != nil {
+		return err
+	}
+	response, err := dedup.NewCiphertextFile(dedup.FILE_RESPONSE, he, encScores)
+	if err != nil {
+		return err
+	}
+	response.Meta[dedup.META_USERS] = fmt.Sprint(bio.DbSize)
+	if verifyID >= 0 {
+		response.Meta[dedup.META_VERIFY] = fmt.Sprint(verifyID)
+	}
+	if err := response.Write(files.response); err != nil {
+		return err
+	}
+	fmt.Printf("Response written to %v (%v ciphertexts).\n", files.response, len(encScores))
+	return nil
+}
+
+// BP: decrypts the response and reports the $topK closest users (or the verification score)
+func decrypt(files lifecycleFiles, topK int) error {
+	setup, he, err := loadHandler(files, true)
+	if err != nil {
+		return err
+	}
+	response, err := dedup.ReadJanusFile(files.response, dedup.FILE_RESPONSE)
+	if err != nil {
+		return err
+	}
+	bio := setup.Bio
+	if bio.DbSize, err = fileUsers(response); err != nil {
+		return err
+	}
+	encScores, err := response.CiphertextsFor(he)
+	if err != nil {
+		return err
+	}
+	modality, err := dedup.LookupModality(bio.BioType)
+	if err != nil {
+		return err
+	}
+
+	if v, ok := response.Meta[dedup.META_VERIFY]; ok {
+		userID, err := strconv.Atoi(v)
+		if err != nil || len(encScores) != 1 {
+			return fmt.Errorf("invalid verification response")
+		}
+		score := dedup.DecodeScores(bio.BioType, []uint64{dedup.BPprocessVerifyReq(encScores[0], he, &bio, userID)}, he.Params.T())[0]
+		fmt.Printf("Verification of user %v: score %v\n", userID, score)
+		if modality.SignedScore() {
+			fmt.Printf("Match: %v\n", score < 0)
+		}
+		return nil
+	}
+
+	answer, err := dedup.BPprocessJanusIdReq(encScores, he, &bio)
+	if err != nil {
+		return err
+	}
+	scores := dedup.DecodeScores(bio.BioType, answer, he.Params.T())
+	if topK <= 0 {
+		topK = DEFAULT_DECRYPT_TOPK
+	}
+	fmt.Printf("Top-%v candidates (userID, score): %v\n", topK, dedup.TopKCandidates(scores, topK))
+	if modality.SignedScore() {
+		// a negative score shows a match
+		matches := []int{}
+		for i, s := range scores {
+			if s < 0 {
+				matches = append(matches, i)
+			}
+		}
+		fmt.Printf("Matching users: %v\n", matches)
+	}
+	return nil
+}
+
+// Describes the setup and Janus files
+func inspect(paths []string) error {
+	if len(paths) == 0 {
+		return fmt.Errorf("inspect requires the files to describe as arguments")
+	}
+	for _, path := range paths {
+		f, err := dedup.ReadJanusFile(path, "")
+		if err != nil {
+			setup, setupErr := dedup.ReadSetup(path)
+			if setupErr != nil {
+				return err
+			}
+			fmt.Printf("%v: setup, scheme %v, N=%v, T=%v, Q = %v bits\n    %v",
+				path, setup.Scheme, setup.HE.N(), setup.HE.T(), setup.HE.LogQ(), setup.Bio.Describe())
+			continue
+		}
+		size := 0
+		for _, item := range f.Items {
+			size += len(item)
+		}
+		fmt.Printf("%v: %v, key epoch %v, %v items (%v Bytes) %v\n", path, f.Kind, f.Epoch, len(f.Items), size, f.DescribeMeta())
+		if f.Kind == dedup.FILE_TEMPLATES && len(f.Items) > 0 {
+			templates, err := f.Templates()
+			if err != nil {
+				return err
+			}
+			bio := templates[0]
+			fmt.Printf("    %v templates of size %v in [0, %v), masks %v\n", bio.BioMode, len(bio.Data), bio.MaxVal, bio.HasMask)
+		}
+	}
+	return nil
+}
+
+// Runs the lifecycle subcommands that do not select parameters (all but keygen)
+func runLifecycle(command string, files lifecycleFiles, n int, useSynthetic bool, probe int, args []string) error {
+	switch command {
+	case "enroll":
+		return enroll(files, n, useSynthetic, probe)
+	case "encrypt-db":
+		return encryptDB(files)
+	case "identify":
+		return identify(files, verify_id)
+	case "decrypt":
+		return decrypt(files, top_k)
+	case "inspect":
+		return inspect(args)
+	}
+	return fmt.Errorf("unknown command %v", command)
+}
+
+// Returns the generator of the $stream data (template or probe) of the user $index, seeded
+// with -seed
+// The seed and the index are hashed: unlike data_seed+index, the users of two seeds do not
+// overlap.
+func userDataRng(stream string, index int) *rand.Rand {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%v/%v/%v", data_seed, stream, index)
+	return rand.New(rand.NewSource(int64(h.Sum64())))
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"local.com/dedup/dedup"
+)
+
+// Lifecycle files in a temporary directory
+func testLifecycleFiles(t *testing.T) lifecycleFiles {
+	dir := t.TempDir()
+	return lifecycleFiles{
+		setup:     filepath.Join(dir, "janus_setup.json"),
+		sk:        filepath.Join(dir, "janus_bp.sk"),
+		keys:      filepath.Join(dir, "janus_keys"),
+		templates: filepath.Join(dir, "janus_templates"),
+		encDB:     filepath.Join(dir, "janus_encdb"),
+		query:     filepath.Join(dir, "janus_query"),
+		response:  filepath.Join(dir, "janus_response"),
+	}
+}
+
+// Decrypts the identification response with the BP key and checks it against the plaintext
+// scores of the query and the enrolled templates
+func checkResponse(t *testing.T, files lifecycleFiles) {
+	t.Helper()
+	setup, he, err := loadHandler(files, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readTemplates := func(path string) []*dedup.PlainBio {
+		f, err := dedup.ReadJanusFile(path, dedup.FILE_TEMPLATES)
+		if err != nil {
+			t.Fatal(err)
+		}
+		templates, err := f.Templates()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return templates
+	}
+	db, query := readTemplates(files.templates), readTemplates(files.query)[0]
+
+	response, err := dedup.ReadJanusFile(files.response, dedup.FILE_RESPONSE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encScores, err := response.CiphertextsFor(he)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bio := setup.Bio
+	bio.DbSize = len(db)
+	answer, err := dedup.BPprocessJanusIdReq(encScores, he, &bio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groundTruth := make([]int64, len(db))
+	for i := range db {
+		groundTruth[i] = bio.ComputeScore(query, db[i])
+	}
+	if err := dedup.CheckAnswer(answer, groundTruth, he.Params.T()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLifecycleRoundTrip(t *testing.T) {
+	for _, scheme := range []string{dedup.SCHEME_BFV, dedup.SCHEME_BGV} {
+		t.Run(scheme, func(t *testing.T) {
+			she_scheme = scheme
+			defer func() { she_scheme = dedup.SCHEME_BFV }()
+
+			files := testLifecycleFiles(t)
+			bio := &dedup.JanusParams{DbSize: 40, BioType: "finger", TemplateSize: 64, SlotsPerCtx: 4, CtxPerTemplate: 16, SensorD: 256}
+			params, err := dedup.SelectBFVParams(bio, dedup.Classical128)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bio.Nbfv = params.N()
+			if err := keygen(files, bio, params); err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(files.sk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm()&0077 != 0 {
+				t.Errorf("secret key file mode %v", info.Mode().Perm())
+			}
+
+			// two enrollment batches
+			if err := enroll(files, 30, false, -1); err != nil {
+				t.Fatal(err)
+			}
+			if err := enroll(files, 10, false, 2); err != nil {
+				t.Fatal(err)
+			}
+			if err := encryptDB(files); err != nil {
+				t.Fatal(err)
+			}
+			if err := identify(files, -1); err != nil {
+				t.Fatal(err)
+			}
+			checkResponse(t, files)
+			if err := decrypt(files, 5); err != nil {
+				t.Fatal(err)
+			}
+
+			// the RS keys of another key generation cannot load the encrypted DB
+			other := files
+			other.setup = filepath.Join(t.TempDir(), "janus_setup.json")
+			other.sk = filepath.Join(t.TempDir(), "janus_bp.sk")
+			other.keys = filepath.Join(t.TempDir(), "janus_keys")
+			if err := keygen(other, bio, params); err != nil {
+				t.Fatal(err)
+			}
+			if err := identify(other, -1); !errors.Is(err, dedup.ErrParamMismatch) {
+				t.Errorf("identify with the keys of another key generation: got %v, want ErrParamMismatch", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package dedup
+
+import (
+	"github.com/tuneinsight/lattigo/v4/bfv"
+	"github.com/tuneinsight/lattigo/v4/bgv"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// SHE schemes supported by HEHandler
+// Both schemes use the same ring, ciphertext modulus and plaintext modulus, described by
+// bfv.Parameters, and the same (scheme independent) RLWE keys.
+const (
+	SCHEME_BFV = "bfv"
+	SCHEME_BGV = "bgv"
+)
+
+// Encoder used by the strip packing algorithms, the slots hold integers modulo T
+type SHEEncoder interface {
+	EncodeNew(values interface{}, level int) (pt *rlwe.Plaintext)
+	// Encodes a plaintext used as the operand of a multiplication
+	EncodeMulNew(values interface{}, level int) (pt rlwe.Operand)
+	DecodeUintNew(pt *rlwe.Plaintext) (values []uint64)
+}
+
+// Evaluator used by the strip packing algorithms
+type SHEEvaluator interface {
+	Add(ctIn *rlwe.Ciphertext, op1 rlwe.Operand, ctOut *rlwe.Ciphertext)
+	AddNew(ctIn *rlwe.Ciphertext, op1 rlwe.Operand) (ctOut *rlwe.Ciphertext)
+	Sub(ctIn *rlwe.Ciphertext, op1 rlwe.Operand, ctOut *rlwe.Ciphertext)
+	SubNew(ctIn *rlwe.Ciphertext, op1 rlwe.Operand) (ctOut *rlwe.Ciphertext)
+	Mul(ctIn *rlwe.Ciphertext, op1 rlwe.Operand, ctOut *rlwe.Ciphertext)
+	MulNew(ctIn *rlwe.Ciphertext, op1 rlwe.Operand) (ctOut *rlwe.Ciphertext)
+	MulScalarNew(ctIn *rlwe.Ciphertext, scalar uint64) (ctOut *rlwe.Ciphertext)
+	Relinearize(ctIn *rlwe.Ciphertext, ctOut *rlwe.Ciphertext)
+	InnerSum(ctIn *rlwe.Ciphertext, batchSize, n int, ctOut *rlwe.Ciphertext)
+	RotateColumns(ctIn *rlwe.Ciphertext, k int, ctOut *rlwe.Ciphertext)
+	RotateColumnsNew(ctIn *rlwe.Ciphertext, k int) (ctOut *rlwe.Ciphertext)
+
+	// Modulus switching of ctx to $level (in place)
+	ModSwitchTo(ctx *rlwe.Ciphertext, level int) error
+}
+
+type bfvEncoder struct {
+	bfv.Encoder
+}
+
+func (enc bfvEncoder) EncodeMulNew(values interface{}, level int) rlwe.Operand {
+	return enc.Encoder.EncodeMulNew(values, level)
+}
+
+func (enc bfvEncoder) DecodeUintNew(pt *rlwe.Plaintext) []uint64 {
+	return enc.Encoder.DecodeUintNew(pt)
+}
+
+type bfvEvaluator struct {
+	bfv.Evaluator
+}
+
+func (eval bfvEvaluator) ModSwitchTo(ctx *rlwe.Ciphertext, level int) error {
+	eval.RescaleTo(level, ctx, ctx)
+	return nil
+}
+
+type bgvEncoder struct {
+	bgv.Encoder
+}
+
+// BGV plaintexts are encoded with scale 1, the scale of the ciphertexts is tracked by the evaluator
+func (enc bgvEncoder) EncodeNew(values interface{}, level int) *rlwe.Plaintext {
+	return enc.Encoder.EncodeNew(values, level, rlwe.NewScale(1))
+}
+
+func (enc bgvEncoder) EncodeMulNew(values interface{}, level int) rlwe.Operand {
+	return enc.EncodeNew(values, level)
+}
+
+type bgvEvaluator struct {
+	bgv.Evaluator
+}
+
+// In BGV, each rescale divides the ciphertext (and its noise) by the last prime of the modulus
+// The rescale fails if the scale of ctx is not invertible modulo T.
+func (eval bgvEvaluator) ModSwitchTo(ctx *rlwe.Ciphertext, level int) error {
+	for ctx.Level() > level {
+		if err := eval.Rescale(ctx, ctx); err != nil {
+			return paramMismatch("BGV rescale of a level %v ciphertext: %v", ctx.Level(), err)
+		}
+	}
+	return nil
+}
+
+// Returns the BGV parameters with the same ring, modulus and plaintext modulus as $params
+func BGVParams(params bfv.Parameters) (bgv.Parameters, error) {
+	// BGV ciphertexts are kept in the NTT domain, the RLWE parameters are rebuilt accordingly
+	return bgv.NewParametersFromLiteral(bgv.ParametersLiteral(params.ParametersLiteral()))
+}
+
+// Instantiates the encoder, encryptor, decryptor and evaluator of $scheme
+func (he *HEHandler) setBackend(params bfv.Parameters, sk *rlwe.SecretKey, pk *rlwe.PublicKey, evk rlwe.EvaluationKey) error {
+	he.Decryptor = nil
+	switch he.Scheme {
+	case "", SCHEME_BFV:
+		he.Encoder = bfvEncoder{bfv.NewEncoder(params)}
+		if sk != nil {
+			he.Decryptor = bfv.NewDecryptor(params, sk)
+		}
+		he.Encryptor = bfv.NewEncryptor(params, pk)
+		he.Evaluator = bfvEvaluator{bfv.NewEvaluator(params, evk)}
+	case SCHEME_BGV:
+		bgvParams, err := BGVParams(params)
+		if err != nil {
+			return err
+		}
+		he.Encoder = bgvEncoder{bgv.NewEncoder(bgvParams)}
+		if sk != nil {
+			he.Decryptor = bgv.NewDecryptor(bgvParams, sk)
+		}
+		he.Encryptor = bgv.NewEncryptor(bgvParams, pk)
+		he.Evaluator = bgvEvaluator{bgv.NewEvaluator(bgvParams, evk)}
+	default:
+		return paramMismatch("scheme %v not supported", he.Scheme)
+	}
+	return nil
+}
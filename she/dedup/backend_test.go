@@ -0,0 +1,19 @@
+package dedup
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSetKeysRejectsUnknownScheme(t *testing.T) {
+	bio := testParams("finger")
+	params, err := SelectBFVParams(bio, Classical128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bio.Nbfv = params.N()
+	he := &HEHandler{Scheme: "ckks"}
+	if err := he.KeyGenForJanus(params, bio); !errors.Is(err, ErrParamMismatch) {
+		t.Errorf("KeyGenForJanus with scheme %v: got %v, want ErrParamMismatch", he.Scheme, err)
+	}
+}
@@ -0,0 +1,179 @@
+package dedup
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+
+	"github.com/tuneinsight/lattigo/v4/bfv"
+	"github.com/tuneinsight/lattigo/v4/ring"
+)
+
+type SecurityLevel int
+
+const (
+	Classical128   SecurityLevel = iota // 128-bit classical security
+	PostQuantum128                      // 128-bit post-quantum security
+)
+
+func (sec SecurityLevel) String() string {
+	if sec == PostQuantum128 {
+		return "128-bit post-quantum"
+	}
+	return "128-bit classical"
+}
+
+// Safety margin (in bits) kept on top of the estimated noise
+const NOISE_MARGIN_BITS = 2
+
+// Returns the range [low, high] of the score computed by the identification, see the
+// ScoreRange of the modality (unknown modalities use the finger Euclidean distance)
+func (bio JanusParams) ScoreRange() (low, high int64) {
+	m, err := LookupModality(bio.BioType)
+	if err != nil {
+		m = fingerModality{}
+	}
+	return m.ScoreRange(bio)
+}
+
+// Returns the smallest plaintext modulus able to represent all scores without wrap-around
+// Signed scores are decoded as values in (-T/2, T/2].
+func (bio JanusParams) MinPlaintextModulus() uint64 {
+	low, high := bio.ScoreRange()
+	if low < 0 {
+		if -low > high {
+			high = -low
+		}
+		return 2*uint64(high) + 2
+	}
+	return uint64(high) + 1
+}
+
+// Returns the smallest prime T >= min with T = 1 mod 2N (required for SIMD batching)
+func NTTFriendlyPrime(min uint64, logN int) (uint64, error) {
+	nthRoot := uint64(2) << logN
+	t := ((min+nthRoot-2)/nthRoot)*nthRoot + 1
+	if ring.IsPrime(t) {
+		return t, nil
+	}
+	return ring.NextNTTPrime(t, int(nthRoot))
+}
+
+// Estimates log2 of the noise in the output ciphertexts of the identification circuit
+// The estimate was fitted on measurements of the finger circuit (one ciphertext multiplication,
+// CtxPerTemplate additions and the inner sum), the iris circuit has a slightly lower noise.
+func EstimateNoiseBits(logN, logT, ctxPerTemplate int) float64 {
+	return float64(logT) + 1.5*float64(logN) + 1 + 0.5*math.Log2(float64(ctxPerTemplate))
+}
+
+// Additional noise (in bits) of the finger distances on top of the Euclidean circuit
+// weighted: plaintext multiplication by the weights (as the masking of PackResults)
+// l1: ciphertext multiplications and scalar multiplication of the |x - y| polynomial
+func (bio JanusParams) distanceNoiseBits(logN, logT int) float64 {
+	if bio.BioType != "finger" {
+		return 0
+	}
+	switch bio.Distance {
+	case DIST_WEIGHTED_EUCLIDEAN:
+		return float64(logT + logN)
+	case DIST_L1:
+		depth := l1PolyDepth(bio.SensorD)
+		if depth == 0 {
+			return 0
+		}
+		return float64(depth*(logT+logN+1) + logT)
+	}
+	return 0
+}
+
+// Estimates log2 of the noise of the identification outputs of $bio with the HE parameters
+// of ring degree 2^$logN and plaintext modulus of $logT bits, including the masking of
+// PackResults and the finger distance circuit.
+func (bio JanusParams) estimatedNoiseBits(logN, logT, ctxPerTemplate int) float64 {
+	noise := EstimateNoiseBits(logN, logT, ctxPerTemplate)
+	if bio.PackResults {
+		// masking plaintext multiplication
+		noise += float64(logT + logN)
+	}
+	return noise + bio.distanceNoiseBits(logN, logT)
+}
+
+// Noise budget (bits) of fresh ciphertexts: the decryption is correct while the noise is
+// smaller than Q/(2T)
+func noiseBudgetBits(params bfv.Parameters) float64 {
+	return float64(params.LogQ()) - float64(bits.Len64(params.T())) - 1
+}
+
+// Checks that the estimated noise of the identification outputs fits in the noise budget
+func (bio JanusParams) checkNoiseBudget(params bfv.Parameters) error {
+	noise := bio.estimatedNoiseBits(params.LogN(), bits.Len64(params.T()), bio.CtxPerTemplate)
+	if budget := noiseBudgetBits(params); noise+NOISE_MARGIN_BITS >= budget {
+		return paramMismatch("estimated noise of %.1f bits exceeds the noise budget of %.1f bits of N=%v, Q = %v bits, T=%v",
+			noise+NOISE_MARGIN_BITS, budget, params.N(), params.LogQ(), params.T())
+	}
+	return nil
+}
+
+// Candidate BFV presets ordered by ring size and modulus size
+func bfvPresets(security SecurityLevel) []bfv.ParametersLiteral {
+	presets := append([]bfv.ParametersLiteral{}, bfv.DefaultPostQuantumParams...)
+	if security == Classical128 {
+		presets = append(presets, bfv.DefaultParams...)
+	}
+	logQP := func(pl bfv.ParametersLiteral) int {
+		p, err := bfv.NewParametersFromLiteral(pl)
+		if err != nil {
+			return math.MaxInt
+		}
+		return p.LogQP()
+	}
+	sort.SliceStable(presets, func(i, j int) bool {
+		if presets[i].LogN != presets[j].LogN {
+			return presets[i].LogN < presets[j].LogN
+		}
+		return logQP(presets[i]) < logQP(presets[j])
+	})
+	return presets
+}
+
+// Selects the smallest BFV preset with the given security level able to compute the
+// identification score of $bio without wrap-around and with sufficient noise budget.
+// The plaintext modulus T is the smallest NTT-friendly prime larger than the maximum score.
+func SelectBFVParams(bio *JanusParams, security SecurityLevel) (bfv.Parameters, error) {
+	return selectBFVParams(bio, security, 0)
+}
+
+// Parameter selection keeping $extraBits of noise budget on top of the identification noise
+func selectBFVParams(bio *JanusParams, security SecurityLevel, extraBits float64) (bfv.Parameters, error) {
+	minT := bio.MinPlaintextModulus()
+	ctxPerTemplate := bio.CtxPerTemplate
+	if ctxPerTemplate <= 0 {
+		// worst case: a single slot per ciphertext
+		ctxPerTemplate = bio.TemplateSize
+	}
+
+	for _, pl := range bfvPresets(security) {
+		T, err := NTTFriendlyPrime(minT, pl.LogN)
+		if err != nil {
+			continue
+		}
+		pl.T = T
+		params, err := bfv.NewParametersFromLiteral(pl)
+		if err != nil {
+			continue
+		}
+		if params.PCount() == 0 {
+			// the rotations and the relinearization key switch with the special modulus P
+			// (e.g., PN11QP54 only has a power-of-two decomposition)
+			continue
+		}
+
+		noise := bio.estimatedNoiseBits(pl.LogN, bits.Len64(T), ctxPerTemplate) + extraBits
+		if noise+NOISE_MARGIN_BITS < noiseBudgetBits(params) {
+			return params, nil
+		}
+	}
+	return bfv.Parameters{}, fmt.Errorf("SelectBFVParams: no %v preset supports %v Sensor(%v, %v) (max score needs T >= %v)",
+		security, bio.BioType, bio.TemplateSize, bio.SensorD, minT)
+}
@@ -0,0 +1,307 @@
+package dedup
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/tuneinsight/lattigo/v4/ckks"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// CKKS path for real-valued embeddings
+// The embeddings use the same strip packing as the integer templates: each template is split
+// between CtxPerTemplate ciphertexts holding SlotsPerCtx (complex) slots of the template and
+// (N/2)/SlotsPerCtx templates are batched in each ciphertext.
+// The identification consumes two levels: the score product and the selection of the slots
+// holding the scores.
+
+// Default CKKS parameters of the embedding path (depth 5, scale 2^30)
+var DefaultCKKSParams = ckks.PN13QP218
+
+type CKKSHandler struct {
+	Params    ckks.Parameters
+	Encoder   ckks.Encoder
+	Encryptor rlwe.Encryptor
+	Decryptor rlwe.Decryptor
+	Evaluator ckks.Evaluator
+
+	SecretKey *rlwe.SecretKey // only held by the biometric provider
+	PublicKey *rlwe.PublicKey
+	EvalKey   rlwe.EvaluationKey
+}
+
+// Generates the keys with the rotation keys used by the strip sum of $bio
+func (he *CKKSHandler) KeyGen(params ckks.Parameters, bio *JanusParams) {
+	kgen := ckks.NewKeyGenerator(params)
+	sk, pk := kgen.GenKeyPair()
+	galEls := make([]uint64, 0)
+	for _, rot := range bio.innerSumRotations() {
+		galEls = append(galEls, params.GaloisElementForColumnRotationBy(rot))
+	}
+	evk := rlwe.EvaluationKey{
+		Rlk:  kgen.GenRelinearizationKey(sk, 1),
+		Rtks: kgen.GenRotationKeys(galEls, sk),
+	}
+
+	he.Params = params
+	he.SecretKey = sk
+	he.PublicKey = pk
+	he.EvalKey = evk
+	he.Encoder = ckks.NewEncoder(params)
+	he.Decryptor = ckks.NewDecryptor(params, sk)
+	he.Encryptor = ckks.NewEncryptor(params, pk)
+	he.Evaluator = ckks.NewEvaluator(params, evk)
+}
+
+func (priv *CKKSHandler) GetPublicHandler() *CKKSHandler {
+	return &CKKSHandler{
+		Params:    priv.Params,
+		Encoder:   priv.Encoder,
+		Encryptor: priv.Encryptor,
+		Decryptor: nil,
+		Evaluator: priv.Evaluator,
+		SecretKey: nil,
+		PublicKey: priv.PublicKey,
+		EvalKey:   priv.EvalKey,
+	}
+}
+
+func (he *CKKSHandler) encodeNew(values []float64, level int) *rlwe.Plaintext {
+	return he.Encoder.EncodeNew(values, level, he.Params.DefaultScale(), he.Params.LogSlots())
+}
+
+type FloatStrip struct {
+	CtxPerTemplate int // number of ciphertexts, first dimension of Strips
+	SlotPerCtx     int // number of batched elements from each record in a ciphertext, must be a power of 2
+	RecPerCtx      int // number of records per ciphertext, N/2 = SlotPerCtx * recPerCtx
+
+	Strips [][]float64
+}
+
+type CtxFloatStrip struct {
+	CtxPerTemplate int
+	SlotPerCtx     int
+	RecPerCtx      int
+
+	Strips []*rlwe.Ciphertext
+}
+
+// Takes m embeddings of dimension TS <= CtxPerTemplate*SlotsPerCtx and stripes them into
+// m/recPerCtx FloatStrips, embeddings are zero padded. Same layout as StripRecords.
+func StripFloatRecords(params *JanusParams, records [][]float64) ([]*FloatStrip, error) {
+	size := params.CtxPerTemplate * params.SlotsPerCtx
+	recPerCtx := params.Nbfv / params.SlotsPerCtx
+	stripeNum := (len(records) + recPerCtx - 1) / recPerCtx
+	outStrips := make([]*FloatStrip, stripeNum)
+	for st := 0; st < stripeNum; st++ {
+		strip := &FloatStrip{
+			Strips:         make([][]float64, params.CtxPerTemplate),
+			CtxPerTemplate: params.CtxPerTemplate,
+			SlotPerCtx:     params.SlotsPerCtx,
+			RecPerCtx:      recPerCtx,
+		}
+
+		stEnd := (st + 1) * recPerCtx
+		if stEnd > len(records) {
+			stEnd = len(records)
+		}
+		activeRecs := records[st*recPerCtx : stEnd]
+		for _, rec := range activeRecs {
+			if len(rec) > size {
+				return nil, fmt.Errorf("StripFloatRecords: %w. TS(%v) > CtxPerTemplate(%v)*SlotsPerCtx(%v)", ErrParamMismatch, len(rec), params.CtxPerTemplate, params.SlotsPerCtx)
+			}
+		}
+
+		for i := 0; i < params.CtxPerTemplate; i++ { // for each ciphertext
+			strip.Strips[i] = make([]float64, params.Nbfv)
+			for rec := 0; rec < len(activeRecs); rec++ { // for each record from this strip batch
+				for j := 0; j < params.SlotsPerCtx && i*params.SlotsPerCtx+j < len(activeRecs[rec]); j++ {
+					strip.Strips[i][rec*params.SlotsPerCtx+j] = activeRecs[rec][i*params.SlotsPerCtx+j]
+				}
+			}
+		}
+		outStrips[st] = strip
+	}
+	return outStrips, nil
+}
+
+// Replicates a single embedding into a FloatStrip
+func ReplicateAsFloatStripRecords(params *JanusParams, record []float64) (*FloatStrip, error) {
+	recPerCtx := params.Nbfv / params.SlotsPerCtx
+	replicates := make([][]float64, recPerCtx)
+	for i := range replicates {
+		replicates[i] = record
+	}
+	strips, err := StripFloatRecords(params, replicates)
+	if err != nil {
+		return nil, err
+	}
+	return strips[0], nil
+}
+
+func (base *FloatStrip) Encrypt(he *CKKSHandler) *CtxFloatStrip {
+	out := &CtxFloatStrip{
+		CtxPerTemplate: base.CtxPerTemplate,
+		SlotPerCtx:     base.SlotPerCtx,
+		RecPerCtx:      base.RecPerCtx,
+		Strips:         make([]*rlwe.Ciphertext, base.CtxPerTemplate),
+	}
+	for i := range out.Strips {
+		out.Strips[i] = he.Encryptor.EncryptNew(he.encodeNew(base.Strips[i], he.Params.MaxLevel()))
+	}
+	return out
+}
+
+// Sums the (rescaled) products of the strip, computes the sum of the SlotPerCtx slots of each
+// record and zeroes all slots except the scores (slots k*SlotPerCtx).
+// Zeroing (instead of randomizing as in BFV) costs one level but does not leak the partial
+// sums to the BP.
+func (base *CtxFloatStrip) stripeSum(he *CKKSHandler, products []*rlwe.Ciphertext) (*rlwe.Ciphertext, error) {
+	sum := products[0]
+	for _, ctx := range products[1:] {
+		he.Evaluator.Add(sum, ctx, sum)
+	}
+	if err := he.Evaluator.Rescale(sum, he.Params.DefaultScale(), sum); err != nil {
+		return nil, err
+	}
+	he.Evaluator.InnerSum(sum, 1, base.SlotPerCtx, sum)
+
+	selector := make([]float64, he.Params.Slots())
+	for k := 0; k < base.RecPerCtx; k++ {
+		selector[k*base.SlotPerCtx] = 1
+	}
+	he.Evaluator.Mul(sum, he.encodeNew(selector, sum.Level()), sum)
+	if err := he.Evaluator.Rescale(sum, he.Params.DefaultScale(), sum); err != nil {
+		return nil, err
+	}
+	return sum, nil
+}
+
+// Encrypted cosine similarity between the (normalized) query and each record of the strip
+func (base *CtxFloatStrip) CosineScore(he *CKKSHandler, query *FloatStrip) (*rlwe.Ciphertext, error) {
+	products := make([]*rlwe.Ciphertext, base.CtxPerTemplate)
+	for i, ctx := range base.Strips {
+		products[i] = he.Evaluator.MulNew(ctx, he.encodeNew(query.Strips[i], ctx.Level()))
+	}
+	return base.stripeSum(he, products)
+}
+
+// Encrypted squared Euclidean distance between the query and each record of the strip
+func (base *CtxFloatStrip) EuclideanScore(he *CKKSHandler, query *FloatStrip) (*rlwe.Ciphertext, error) {
+	products := make([]*rlwe.Ciphertext, base.CtxPerTemplate)
+	for i, ctx := range base.Strips {
+		diff := he.Evaluator.SubNew(ctx, he.encodeNew(query.Strips[i], ctx.Level()))
+		products[i] = he.Evaluator.MulRelinNew(diff, diff)
+	}
+	return base.stripeSum(he, products)
+}
+
+// Decrypts the scores computed by FloatJanus.Identification
+func BPprocessFloatIdReq(encScores []*rlwe.Ciphertext, he *CKKSHandler, bio *JanusParams) []float64 {
+	answer := make([]float64, 0, bio.DbSize)
+	for _, ctx := range encScores {
+		values := he.Encoder.Decode(he.Decryptor.DecryptNew(ctx), he.Params.LogSlots())
+		for k := 0; k < len(values); k += bio.SlotsPerCtx {
+			answer = append(answer, real(values[k]))
+		}
+	}
+	if len(answer) > bio.DbSize {
+		answer = answer[:bio.DbSize]
+	}
+	return answer
+}
+
+// The RS component for real-valued embeddings (CKKS)
+// $Params.TemplateSize is the embedding dimension and $Params.Nbfv the number of CKKS slots.
+type FloatJanus struct {
+	Params *JanusParams
+	HE     *CKKSHandler
+	Metric string // FLOAT_METRIC_COSINE or FLOAT_METRIC_EUCLIDEAN
+
+	db    []*PlainFloatBio
+	encDB []*CtxFloatStrip
+}
+
+// Generates random unit embeddings for the user database
+func (janus *FloatJanus) GenerateUserDB(rng *rand.Rand) {
+	janus.db = make([]*PlainFloatBio, janus.Params.DbSize)
+	for i := range janus.db {
+		janus.db[i] = NewRandomPlainFloatBio(rng, janus.Params.TemplateSize)
+	}
+}
+
+// Returns an embedding that matches user db[matchIdx]
+func (janus *FloatJanus) GenerateMatchingQuery(rng *rand.Rand, matchIdx int) *PlainFloatBio {
+	return janus.db[matchIdx].CreateFakeMatch(rng, 0.3)
+}
+
+func (janus *FloatJanus) EncryptDatabase() error {
+	if janus.Params.Nbfv != janus.HE.Params.Slots() {
+		return fmt.Errorf("EncryptDatabase: %w, Nbfv(%v) must be the number of CKKS slots (%v)", ErrParamMismatch, janus.Params.Nbfv, janus.HE.Params.Slots())
+	}
+	records := make([][]float64, len(janus.db))
+	for i := range janus.db {
+		records[i] = janus.db[i].Data
+	}
+	strips, err := StripFloatRecords(janus.Params, records)
+	if err != nil {
+		return &PackingError{What: "DB", Err: err}
+	}
+	janus.encDB = make([]*CtxFloatStrip, len(strips))
+	for i := range strips {
+		janus.encDB[i] = strips[i].Encrypt(janus.HE)
+	}
+	return nil
+}
+
+// Computes the encrypted score between the query and each embedding of the database
+// Only the slots k*SlotsPerCtx of the outputs hold scores, the others are zero.
+func (janus *FloatJanus) Identification(query *PlainFloatBio) ([]*rlwe.Ciphertext, error) {
+	queryStrip, err := ReplicateAsFloatStripRecords(janus.Params, query.Data)
+	if err != nil {
+		return nil, &PackingError{What: "Query", Err: err}
+	}
+	out := make([]*rlwe.Ciphertext, len(janus.encDB))
+	for i, strip := range janus.encDB {
+		if janus.Metric == FLOAT_METRIC_COSINE {
+			out[i], err = strip.CosineScore(janus.HE, queryStrip)
+		} else if janus.Metric == FLOAT_METRIC_EUCLIDEAN {
+			out[i], err = strip.EuclideanScore(janus.HE, queryStrip)
+		} else {
+			return nil, fmt.Errorf("metric %v: %w", janus.Metric, ErrUnsupportedModality)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Identification failed: %w", err)
+		}
+	}
+	return out, nil
+}
+
+// Computes the scores using the plain database (ground truth)
+func (janus *FloatJanus) IdentificationGroundTruth(query *PlainFloatBio) ([]float64, error) {
+	answer := make([]float64, janus.Params.DbSize)
+	for i := range answer {
+		score, err := query.ComputeFloatScore(janus.db[i], janus.Metric)
+		if err != nil {
+			return nil, err
+		}
+		answer[i] = score
+	}
+	return answer, nil
+}
+
+// Largest absolute error of the CKKS scores accepted by the correctness check
+const FLOAT_SCORE_TOLERANCE = 1e-3
+
+// Returns the largest absolute error between the decrypted scores and the ground truth
+func MaxFloatError(answer, groundTruth []float64) float64 {
+	maxErr := 0.0
+	for i := range groundTruth {
+		if diff := answer[i] - groundTruth[i]; diff > maxErr {
+			maxErr = diff
+		} else if -diff > maxErr {
+			maxErr = -diff
+		}
+	}
+	return maxErr
+}
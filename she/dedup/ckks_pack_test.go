@@ -0,0 +1,54 @@
+package dedup
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/tuneinsight/lattigo/v4/ckks"
+)
+
+// The decrypted CKKS scores match the plaintext scores within FLOAT_SCORE_TOLERANCE
+// (the CKKS error of DefaultCKKSParams is around 1e-5).
+func TestFloatIdentificationMatchesGroundTruth(t *testing.T) {
+	params, err := ckks.NewParametersFromLiteral(DefaultCKKSParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newParams := func(dbSize int) *JanusParams {
+		return &JanusParams{DbSize: dbSize, BioType: "embedding", TemplateSize: 64, SlotsPerCtx: 4, CtxPerTemplate: 16, Nbfv: params.Slots()}
+	}
+	// the keys only depend on SlotsPerCtx
+	bpHE := &CKKSHandler{}
+	bpHE.KeyGen(params, newParams(1))
+	for _, metric := range []string{FLOAT_METRIC_COSINE, FLOAT_METRIC_EUCLIDEAN} {
+		// 1500 is not a multiple of the slots/SlotsPerCtx = 1024 records of a strip
+		for _, dbSize := range []int{40, 1500} {
+			t.Run(fmt.Sprintf("%v/%v", metric, dbSize), func(t *testing.T) {
+				bio := newParams(dbSize)
+				janus := &FloatJanus{Params: bio, HE: bpHE.GetPublicHandler(), Metric: metric}
+				rng := rand.New(rand.NewSource(1))
+				janus.GenerateUserDB(rng)
+				query := janus.GenerateMatchingQuery(rng, 2)
+				if err := janus.EncryptDatabase(); err != nil {
+					t.Fatal(err)
+				}
+				encScores, err := janus.Identification(query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				answer := BPprocessFloatIdReq(encScores, bpHE, bio)
+				groundTruth, err := janus.IdentificationGroundTruth(query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(answer) != dbSize {
+					t.Fatalf("got %v scores, want %v", len(answer), dbSize)
+				}
+				if maxErr := MaxFloatError(answer, groundTruth); maxErr > FLOAT_SCORE_TOLERANCE {
+					t.Errorf("max absolute error %.2e exceeds %.0e", maxErr, FLOAT_SCORE_TOLERANCE)
+				}
+			})
+		}
+	}
+}
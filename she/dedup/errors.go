@@ -0,0 +1,41 @@
+package dedup
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sentinel errors of the dedup API, test them with errors.Is
+var (
+	// The BioType (or the distance, metric of the modality) is not supported
+	ErrUnsupportedModality = errors.New("unsupported modality")
+	// The biometric, strip or HE parameters are inconsistent
+	ErrParamMismatch = errors.New("mismatching parameters")
+	// A DB or query template could not be packed in strips (see PackingError)
+	ErrPacking = errors.New("packing failed")
+)
+
+// Returns an error wrapping ErrParamMismatch
+func paramMismatch(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: "+format, append([]interface{}{ErrParamMismatch}, args...)...)
+}
+
+// Packing failure of the $What templates (e.g., "DB", "Query mask")
+// It matches ErrPacking and unwraps to its cause, e.g., ErrParamMismatch when the template
+// does not fit in the strip.
+type PackingError struct {
+	What string
+	Err  error
+}
+
+func (e *PackingError) Error() string {
+	return fmt.Sprintf("%v packing failed: %v", e.What, e.Err)
+}
+
+func (e *PackingError) Unwrap() error {
+	return e.Err
+}
+
+func (e *PackingError) Is(target error) bool {
+	return target == ErrPacking
+}
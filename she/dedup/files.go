@@ -0,0 +1,366 @@
+package dedup
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/tuneinsight/lattigo/v4/bfv"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// Files exchanged by the roles of the lifecycle (keygen, enroll, encrypt-db, identify, decrypt)
+// The setup (biometric and HE parameters) is a JSON file shared by all roles. The other files
+// are JanusFile: a kind, the key epoch and serialized items, gob encoded after JANUS_FILE_MAGIC.
+
+const JANUS_FILE_MAGIC = "JANUS1\n"
+
+// Kinds of JanusFile and their items
+const (
+	FILE_SECRET_KEY   = "secret-key"   // the BP secret key
+	FILE_PUBLIC_KEYS  = "public-keys"  // the public key, relinearization key and rotation keys
+	FILE_TEMPLATES    = "templates"    // plaintext templates (JSON PlainBio), e.g., the DB or a query
+	FILE_ENCRYPTED_DB = "encrypted-db" // the ciphertexts of the DB strips (CtxPerTemplate per strip)
+	FILE_RESPONSE     = "response"     // the encrypted scores of an identification or a verification
+)
+
+// Meta data keys of the JanusFile
+const (
+	META_KEY    = "key"    // fingerprint of the public key (see HEHandler.KeyID)
+	META_USERS  = "users"  // number of users of the encrypted DB or of the identification
+	META_VERIFY = "verify" // verified user of a verification response
+)
+
+// Biometric and HE parameters shared by all roles, written by keygen
+// Bio.DbSize is the size of the DB when the setup is written, the roles use the number of users
+// of the encrypted DB (the keys do not depend on it).
+type Setup struct {
+	Scheme string
+	Bio    JanusParams
+	HE     bfv.Parameters
+}
+
+func (setup *Setup) Write(path string) error {
+	data, err := json.MarshalIndent(setup, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Setup.Write: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("Setup.Write: %w", err)
+	}
+	return nil
+}
+
+func ReadSetup(path string) (*Setup, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ReadSetup: %w", err)
+	}
+	setup := &Setup{}
+	if err := json.Unmarshal(data, setup); err != nil {
+		return nil, fmt.Errorf("ReadSetup: %v: %w", path, err)
+	}
+	setup.Bio.Nbfv = setup.HE.N()
+	return setup, nil
+}
+
+type JanusFile struct {
+	Kind  string
+	Epoch int               // key epoch of the keys, encrypted DB and responses
+	Meta  map[string]string // see META_USERS, META_VERIFY
+	Items [][]byte
+}
+
+// Writes the file, secret keys are only readable by their owner
+func (f *JanusFile) Write(path string) error {
+	perm := os.FileMode(0644)
+	if f.Kind == FILE_SECRET_KEY {
+		perm = 0600
+	}
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return fmt.Errorf("JanusFile.Write: %w", err)
+	}
+	// the mode of an existing file is not changed by OpenFile
+	if err := out.Chmod(perm); err != nil {
+		out.Close()
+		return fmt.Errorf("JanusFile.Write: %w", err)
+	}
+	w := bufio.NewWriter(out)
+	if _, err := w.WriteString(JANUS_FILE_MAGIC); err != nil {
+		out.Close()
+		return fmt.Errorf("JanusFile.Write: %w", err)
+	}
+	if err := gob.NewEncoder(w).Encode(f); err != nil {
+		out.Close()
+		return fmt.Errorf("JanusFile.Write: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return fmt.Errorf("JanusFile.Write: %w", err)
+	}
+	return out.Close()
+}
+
+// Reads a JanusFile of the given $kind (any kind if empty)
+func ReadJanusFile(path string, kind string) (*JanusFile, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("ReadJanusFile: %w", err)
+	}
+	defer in.Close()
+	r := bufio.NewReader(in)
+	magic := make([]byte, len(JANUS_FILE_MAGIC))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != JANUS_FILE_MAGIC {
+		return nil, fmt.Errorf("ReadJanusFile: %v is not a Janus file", path)
+	}
+	f := &JanusFile{}
+	if err := gob.NewDecoder(r).Decode(f); err != nil {
+		return nil, fmt.Errorf("ReadJanusFile: %v: %w", path, err)
+	}
+	if kind != "" && f.Kind != kind {
+		return nil, fmt.Errorf("ReadJanusFile: %w, %v is a %v file, expected %v", ErrParamMismatch, path, f.Kind, kind)
+	}
+	return f, nil
+}
+
+// Returns the meta data of the file as sorted "key=value" strings
+func (f *JanusFile) DescribeMeta() []string {
+	out := make([]string, 0, len(f.Meta))
+	for k, v := range f.Meta {
+		out = append(out, fmt.Sprintf("%v=%v", k, v))
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Fingerprint of the public key
+// Files of independent key generations may share the key epoch, the fingerprint tells them apart.
+func (he *HEHandler) KeyID() (string, error) {
+	pk, err := he.PublicKey.MarshalBinary()
+	if err != nil {
+		return "", fmt.Errorf("KeyID: %w", err)
+	}
+	sum := sha256.Sum256(pk)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// Checks that the file was produced under the keys of $he
+func (f *JanusFile) checkKey(he *HEHandler) error {
+	id, err := he.KeyID()
+	if err != nil {
+		return err
+	}
+	if f.Epoch != he.Epoch || f.Meta[META_KEY] != id {
+		return fmt.Errorf("%w, %v file of key %v (epoch %v), handler key %v (epoch %v)",
+			ErrParamMismatch, f.Kind, f.Meta[META_KEY], f.Epoch, id, he.Epoch)
+	}
+	return nil
+}
+
+// Serializes the keys of the handler: the secret key (nil for a public handler) and the
+// public and evaluation keys
+func (he *HEHandler) MarshalKeys() (secret, public *JanusFile, err error) {
+	pk, err := he.PublicKey.MarshalBinary()
+	if err != nil {
+		return nil, nil, fmt.Errorf("MarshalKeys: %w", err)
+	}
+	rlk, err := he.EvalKey.Rlk.MarshalBinary()
+	if err != nil {
+		return nil, nil, fmt.Errorf("MarshalKeys: %w", err)
+	}
+	rtks, err := he.EvalKey.Rtks.MarshalBinary()
+	if err != nil {
+		return nil, nil, fmt.Errorf("MarshalKeys: %w", err)
+	}
+	id, err := he.KeyID()
+	if err != nil {
+		return nil, nil, fmt.Errorf("MarshalKeys: %w", err)
+	}
+	meta := map[string]string{META_KEY: id}
+	public = &JanusFile{Kind: FILE_PUBLIC_KEYS, Epoch: he.Epoch, Meta: meta, Items: [][]byte{pk, rlk, rtks}}
+
+	if he.SecretKey != nil {
+		sk, err := he.SecretKey.MarshalBinary()
+		if err != nil {
+			return nil, nil, fmt.Errorf("MarshalKeys: %w", err)
+		}
+		secret = &JanusFile{Kind: FILE_SECRET_KEY, Epoch: he.Epoch, Meta: meta, Items: [][]byte{sk}}
+	}
+	return secret, public, nil
+}
+
+// Instantiates the handler of the setup from the key files, $secret is nil for the RS
+func LoadHandler(setup *Setup, public, secret *JanusFile) (*HEHandler, error) {
+	if public.Kind != FILE_PUBLIC_KEYS || len(public.Items) != 3 {
+		return nil, fmt.Errorf("LoadHandler: %w, invalid %v file", ErrParamMismatch, FILE_PUBLIC_KEYS)
+	}
+	pk := new(rlwe.PublicKey)
+	if err := pk.UnmarshalBinary(public.Items[0]); err != nil {
+		return nil, fmt.Errorf("LoadHandler: %w", err)
+	}
+	evk := rlwe.EvaluationKey{Rlk: new(rlwe.RelinearizationKey), Rtks: new(rlwe.RotationKeySet)}
+	if err := evk.Rlk.UnmarshalBinary(public.Items[1]); err != nil {
+		return nil, fmt.Errorf("LoadHandler: %w", err)
+	}
+	if err := evk.Rtks.UnmarshalBinary(public.Items[2]); err != nil {
+		return nil, fmt.Errorf("LoadHandler: %w", err)
+	}
+
+	var sk *rlwe.SecretKey
+	if secret != nil {
+		if secret.Kind != FILE_SECRET_KEY || len(secret.Items) != 1 {
+			return nil, fmt.Errorf("LoadHandler: %w, invalid %v file", ErrParamMismatch, FILE_SECRET_KEY)
+		}
+		if secret.Epoch != public.Epoch || secret.Meta[META_KEY] != public.Meta[META_KEY] {
+			return nil, fmt.Errorf("LoadHandler: %w, secret key %v (epoch %v), public keys %v (epoch %v)",
+				ErrParamMismatch, secret.Meta[META_KEY], secret.Epoch, public.Meta[META_KEY], public.Epoch)
+		}
+		sk = new(rlwe.SecretKey)
+		if err := sk.UnmarshalBinary(secret.Items[0]); err != nil {
+			return nil, fmt.Errorf("LoadHandler: %w", err)
+		}
+	}
+
+	he := &HEHandler{
+		Scheme:    setup.Scheme,
+		Params:    setup.HE,
+		SecretKey: sk,
+		PublicKey: pk,
+		EvalKey:   evk,
+		Epoch:     public.Epoch,
+	}
+	if err := he.setBackend(setup.HE, sk, pk, evk); err != nil {
+		return nil, fmt.Errorf("LoadHandler: %w", err)
+	}
+	if err := public.checkKey(he); err != nil {
+		return nil, fmt.Errorf("LoadHandler: %w", err)
+	}
+	return he, nil
+}
+
+func NewTemplatesFile(templates []*PlainBio) (*JanusFile, error) {
+	f := &JanusFile{Kind: FILE_TEMPLATES, Items: make([][]byte, len(templates))}
+	for i, bio := range templates {
+		var err error
+		if f.Items[i], err = json.Marshal(bio); err != nil {
+			return nil, fmt.Errorf("NewTemplatesFile: %w", err)
+		}
+	}
+	return f, nil
+}
+
+func (f *JanusFile) Templates() ([]*PlainBio, error) {
+	if f.Kind != FILE_TEMPLATES {
+		return nil, fmt.Errorf("Templates: %w, %v file", ErrParamMismatch, f.Kind)
+	}
+	out := make([]*PlainBio, len(f.Items))
+	for i := range f.Items {
+		out[i] = &PlainBio{}
+		if err := json.Unmarshal(f.Items[i], out[i]); err != nil {
+			return nil, fmt.Errorf("Templates: template %v: %w", i, err)
+		}
+	}
+	return out, nil
+}
+
+// File of $kind holding ciphertexts encrypted under the current key of $he
+func NewCiphertextFile(kind string, he *HEHandler, ctxs []*rlwe.Ciphertext) (*JanusFile, error) {
+	id, err := he.KeyID()
+	if err != nil {
+		return nil, fmt.Errorf("NewCiphertextFile: %w", err)
+	}
+	items, err := MarshalCtxArray(ctxs)
+	if err != nil {
+		return nil, fmt.Errorf("NewCiphertextFile: %w", err)
+	}
+	return &JanusFile{Kind: kind, Epoch: he.Epoch, Meta: map[string]string{META_KEY: id}, Items: items}, nil
+}
+
+// Returns the ciphertexts of the file, which must be produced under the keys of $he
+func (f *JanusFile) CiphertextsFor(he *HEHandler) ([]*rlwe.Ciphertext, error) {
+	if err := f.checkKey(he); err != nil {
+		return nil, fmt.Errorf("Ciphertexts: %w", err)
+	}
+	return f.Ciphertexts()
+}
+
+func (f *JanusFile) Ciphertexts() ([]*rlwe.Ciphertext, error) {
+	if f.Kind != FILE_ENCRYPTED_DB && f.Kind != FILE_RESPONSE {
+		return nil, fmt.Errorf("Ciphertexts: %w, %v file", ErrParamMismatch, f.Kind)
+	}
+	ctxs, err := UnMarshalCtxArray(f.Items)
+	if err != nil {
+		return nil, fmt.Errorf("Ciphertexts: %w", err)
+	}
+	return ctxs, nil
+}
+
+// Checks that the templates (e.g., read from a file) were produced for the parameters of $bio
+func (bio *JanusParams) CheckTemplates(templates []*PlainBio) error {
+	for i, t := range templates {
+		if t.BioMode != bio.BioType || len(t.Data) != bio.TemplateSize || t.MaxVal != bio.SensorD ||
+			(t.HasMask && len(t.Mask) != len(t.Data)) {
+			return paramMismatch("template %v: %v template of size %v in [0, %v), expected %v of size %v in [0, %v)",
+				i, t.BioMode, len(t.Data), t.MaxVal, bio.BioType, bio.TemplateSize, bio.SensorD)
+		}
+	}
+	return nil
+}
+
+// Sets the plaintext DB of the enrollment, its size must be Params.DbSize
+func (janus *Janus) SetUserDB(db []*PlainBio) error {
+	if len(db) != janus.Params.DbSize {
+		return fmt.Errorf("SetUserDB: %w, %v templates for DB[%v]", ErrParamMismatch, len(db), janus.Params.DbSize)
+	}
+	if err := janus.Params.CheckTemplates(db); err != nil {
+		return fmt.Errorf("SetUserDB: %w", err)
+	}
+	janus.db = db
+	return nil
+}
+
+// Serializes the encrypted DB (encrypted with the public key), see LoadDatabase
+func (janus *Janus) MarshalDatabase() (*JanusFile, error) {
+	if janus.encDB == nil {
+		return nil, fmt.Errorf("MarshalDatabase: the DB is not encrypted")
+	}
+	if janus.encDB.keyEpoch != janus.HE.Epoch {
+		return nil, fmt.Errorf("MarshalDatabase: %w, DB of key epoch %v, handler of epoch %v",
+			ErrParamMismatch, janus.encDB.keyEpoch, janus.HE.Epoch)
+	}
+	ctxs := make([]*rlwe.Ciphertext, 0)
+	for _, strip := range janus.encDB.orderedStrips() {
+		ctxs = append(ctxs, strip.Strips...)
+	}
+	f, err := NewCiphertextFile(FILE_ENCRYPTED_DB, janus.HE, ctxs)
+	if err != nil {
+		return nil, fmt.Errorf("MarshalDatabase: %w", err)
+	}
+	f.Meta[META_USERS] = fmt.Sprint(janus.Params.DbSize)
+	return f, nil
+}
+
+// Loads a DB serialized by MarshalDatabase (e.g., by the encrypt-db step of the lifecycle)
+// The DB must be encrypted under the keys of the RS handler.
+func (janus *Janus) LoadDatabase(f *JanusFile) error {
+	if f.Kind != FILE_ENCRYPTED_DB {
+		return fmt.Errorf("LoadDatabase: %w, %v file", ErrParamMismatch, f.Kind)
+	}
+	ctxs, err := f.CiphertextsFor(janus.HE)
+	if err != nil {
+		return fmt.Errorf("LoadDatabase: %w", err)
+	}
+	db, err := janus.groupStrips(ctxs)
+	if err != nil {
+		return fmt.Errorf("LoadDatabase: %w", err)
+	}
+	janus.encDB = db
+	return nil
+}
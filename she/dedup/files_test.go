@@ -0,0 +1,80 @@
+package dedup
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Key files of a fresh key generation for the finger test parameters
+func testKeyFiles(t *testing.T) (*Setup, *JanusFile, *JanusFile) {
+	t.Helper()
+	bio := testParams("finger")
+	bpHE, _ := newTestJanus(t, bio)
+	secret, public, err := bpHE.MarshalKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Setup{Scheme: SCHEME_BFV, Bio: *bio, HE: bpHE.Params}, secret, public
+}
+
+func TestSecretKeyFileMode(t *testing.T) {
+	_, secret, public := testKeyFiles(t)
+	dir := t.TempDir()
+	for _, f := range []*JanusFile{secret, public} {
+		path := filepath.Join(dir, f.Kind)
+		// an existing file is restricted as well
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Write(path); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		worldReadable := info.Mode().Perm()&0044 != 0
+		if want := f.Kind != FILE_SECRET_KEY; worldReadable != want {
+			t.Errorf("%v file mode %v", f.Kind, info.Mode().Perm())
+		}
+	}
+}
+
+func TestWrongFileKind(t *testing.T) {
+	setup, secret, public := testKeyFiles(t)
+	_, otherSecret, _ := testKeyFiles(t)
+	path := filepath.Join(t.TempDir(), "janus.keys")
+	if err := public.Write(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ReadJanusFile(path, FILE_SECRET_KEY); !errors.Is(err, ErrParamMismatch) {
+		t.Errorf("ReadJanusFile of public keys as %v: got %v, want ErrParamMismatch", FILE_SECRET_KEY, err)
+	}
+	if _, err := ReadJanusFile(path, FILE_PUBLIC_KEYS); err != nil {
+		t.Errorf("ReadJanusFile: %v", err)
+	}
+
+	loads := map[string]struct{ public, secret *JanusFile }{
+		"secret key as public keys":      {secret, nil},
+		"public keys as secret key":      {public, public},
+		"secret key of another key pair": {public, otherSecret},
+	}
+	for name, files := range loads {
+		if _, err := LoadHandler(setup, files.public, files.secret); !errors.Is(err, ErrParamMismatch) {
+			t.Errorf("LoadHandler, %v: got %v, want ErrParamMismatch", name, err)
+		}
+	}
+	if _, err := LoadHandler(setup, public, secret); err != nil {
+		t.Errorf("LoadHandler: %v", err)
+	}
+
+	if _, err := public.Templates(); !errors.Is(err, ErrParamMismatch) {
+		t.Errorf("Templates of public keys: got %v, want ErrParamMismatch", err)
+	}
+	if _, err := public.Ciphertexts(); !errors.Is(err, ErrParamMismatch) {
+		t.Errorf("Ciphertexts of public keys: got %v, want ErrParamMismatch", err)
+	}
+}
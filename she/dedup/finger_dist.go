@@ -0,0 +1,294 @@
+package dedup
+
+import (
+	"fmt"
+	"math/big"
+	"math/bits"
+
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// Distances of the finger modality (JanusParams.Distance)
+const (
+	DIST_EUCLIDEAN          = "euclidean" // squared Euclidean distance (default)
+	DIST_WEIGHTED_EUCLIDEAN = "weighted"  // sum_i w_i (x_i - y_i)^2 with the FeatureWeights w
+	DIST_L1                 = "l1"        // sum_i |x_i - y_i|
+)
+
+// Largest sensor domain supported by the L1 distance
+// |x - y| is evaluated as a polynomial of degree D-1 in (x - y)^2, i.e., with
+// ceil(log2(D-1)) additional ciphertext multiplications.
+const L1_MAX_SENSOR_D = 16
+
+// Largest per-feature weight drawn by NewRandomFeatureWeights
+const FEATURE_WEIGHT_MAX = 4
+
+// Returns the finger distance of $bio and checks its parameters
+func (bio JanusParams) fingerDistance() (string, error) {
+	switch bio.Distance {
+	case "", DIST_EUCLIDEAN:
+		return DIST_EUCLIDEAN, nil
+	case DIST_WEIGHTED_EUCLIDEAN:
+		if len(bio.FeatureWeights) != bio.TemplateSize {
+			return "", fmt.Errorf("%w: weighted distance requires TS(%v) feature weights, got %v", ErrParamMismatch, bio.TemplateSize, len(bio.FeatureWeights))
+		}
+		for _, w := range bio.FeatureWeights {
+			if w < 0 {
+				return "", fmt.Errorf("%w: weighted distance requires non-negative feature weights", ErrParamMismatch)
+			}
+		}
+		return DIST_WEIGHTED_EUCLIDEAN, nil
+	case DIST_L1:
+		if bio.SensorHasMask {
+			return "", fmt.Errorf("%w: l1 distance does not support quality masks", ErrParamMismatch)
+		}
+		if bio.SensorD < 2 || bio.SensorD > L1_MAX_SENSOR_D {
+			return "", fmt.Errorf("%w: l1 distance requires 2 <= D <= %v, got D = %v", ErrParamMismatch, L1_MAX_SENSOR_D, bio.SensorD)
+		}
+		return DIST_L1, nil
+	}
+	return "", fmt.Errorf("distance %v: %w", bio.Distance, ErrUnsupportedModality)
+}
+
+// Number of ciphertext multiplications of the |x - y| polynomial on top of the squaring
+func l1PolyDepth(maxVal int64) int {
+	if maxVal <= 2 {
+		return 0
+	}
+	return bits.Len64(uint64(maxVal - 2))
+}
+
+// Returns the coefficients (mod T) of the polynomial p of degree maxVal-1 such that
+// p(d^2) = |d| for all d in (-maxVal, maxVal)
+// p is interpolated on the points (k^2, k) for k in [0, maxVal), which are distinct
+// modulo T as long as T > 2*(maxVal-1) and T is prime.
+func AbsPolyCoeffs(maxVal int64, T uint64) ([]uint64, error) {
+	t := new(big.Int).SetUint64(T)
+	n := int(maxVal)
+	coeffs := make([]*big.Int, n)
+	for i := range coeffs {
+		coeffs[i] = new(big.Int)
+	}
+
+	// Lagrange interpolation, the point k = 0 has value 0
+	for k := 1; k < n; k++ {
+		sk := big.NewInt(int64(k * k))
+		basis := []*big.Int{big.NewInt(1)}
+		denom := big.NewInt(1)
+		for j := 0; j < n; j++ {
+			if j == k {
+				continue
+			}
+			sj := big.NewInt(int64(j * j))
+			// basis *= (s - sj)
+			next := make([]*big.Int, len(basis)+1)
+			for i := range next {
+				next[i] = new(big.Int)
+			}
+			for i, b := range basis {
+				next[i+1].Add(next[i+1], b)
+				next[i].Sub(next[i], new(big.Int).Mul(sj, b))
+			}
+			basis = next
+			denom.Mul(denom, new(big.Int).Sub(sk, sj))
+			denom.Mod(denom, t)
+		}
+		inv := new(big.Int).ModInverse(denom, t)
+		if inv == nil {
+			return nil, fmt.Errorf("AbsPolyCoeffs: interpolation points are not distinct modulo T=%v", T)
+		}
+		scale := inv.Mul(inv, big.NewInt(int64(k)))
+		for i, b := range basis {
+			coeffs[i].Add(coeffs[i], new(big.Int).Mul(scale, b))
+			coeffs[i].Mod(coeffs[i], t)
+		}
+	}
+
+	out := make([]uint64, n)
+	for i := range out {
+		out[i] = coeffs[i].Uint64()
+	}
+	return out, nil
+}
+
+// Evaluates the polynomial with coefficients $coeffs (mod T) on each ciphertext of the strip (in place)
+// The powers are computed with a product tree, i.e., with ceil(log2(deg)) multiplications.
+func (base *CtxStrip) EvaluatePoly(HE *HEHandler, coeffs []uint64) {
+	deg := len(coeffs) - 1
+	var constant *rlwe.Plaintext
+	if coeffs[0] != 0 {
+		data := make([]uint64, HE.Params.N())
+		for i := range data {
+			data[i] = coeffs[0]
+		}
+		constant = HE.Encoder.EncodeNew(data, HE.Params.MaxLevel())
+	}
+
+	for i := 0; i < base.CtxPerTemplate; i++ {
+		powers := make([]*rlwe.Ciphertext, deg+1)
+		powers[1] = base.Strips[i]
+		for p := 2; p <= deg; p++ {
+			// largest power of two smaller than p
+			a := 1 << (bits.Len(uint(p-1)) - 1)
+			powers[p] = HE.Evaluator.MulNew(powers[a], powers[p-a])
+			HE.Evaluator.Relinearize(powers[p], powers[p])
+		}
+
+		res := HE.Evaluator.MulScalarNew(powers[1], coeffs[1])
+		for p := 2; p <= deg; p++ {
+			HE.Evaluator.Add(res, HE.Evaluator.MulScalarNew(powers[p], coeffs[p]), res)
+		}
+		if constant != nil {
+			HE.Evaluator.Add(res, constant, res)
+		}
+		base.Strips[i] = res
+	}
+}
+
+// Multiplies each ciphertext of the strip by the corresponding ciphertext of $target (in place)
+func (base *CtxStrip) MulCtx(HE *HEHandler, target *CtxStrip) {
+	for i := 0; i < base.CtxPerTemplate; i++ {
+		base.Strips[i] = HE.Evaluator.MulNew(base.Strips[i], target.Strips[i])
+		HE.Evaluator.Relinearize(base.Strips[i], base.Strips[i])
+	}
+}
+
+// Computes w.(x - y)^2 in place, the weights are applied to (x - y) as a plaintext
+// strip multiplication before the squaring
+func (base *CtxStrip) weightedSquaredDiff(HE *HEHandler, target, weights *PlainStrip) {
+	base.Sub(HE, target)
+	weighted := base.CopyNew()
+	weighted.Mul(HE, weights)
+	base.MulCtx(HE, weighted)
+}
+
+// Computes |x - y| = p((x - y)^2) in place
+func (base *CtxStrip) absDiff(HE *HEHandler, target *PlainStrip, absPoly []uint64) {
+	base.Sub(HE, target)
+	base.Square(HE)
+	if len(absPoly) > 2 {
+		// binary values (D = 2): |x - y| = (x - y)^2
+		base.EvaluatePoly(HE, absPoly)
+	}
+}
+
+// Weighted distance between the query and each record of the DB, the DB is not modified
+func WeightedEuclideanIdentification(HE *HEHandler, x, weights *PlainStrip, dbStrip []*CtxStrip) []*rlwe.Ciphertext {
+	out := make([]*rlwe.Ciphertext, len(dbStrip))
+	for i := 0; i < len(dbStrip); i++ {
+		strip := dbStrip[i].CopyNew()
+		strip.weightedSquaredDiff(HE, x, weights)
+		out[i] = strip.StripeSum(HE)
+	}
+	return out
+}
+
+// Weighted distance between the query and the $recIdx'th record of the strip
+// All other slots are masked out (randomized). The strip is not modified.
+func WeightedEucVerify(HE *HEHandler, x, weights *PlainStrip, y *CtxStrip, recIdx int) *rlwe.Ciphertext {
+	strip := y.CopyNew()
+	strip.weightedSquaredDiff(HE, x, weights)
+	dist := strip.stripeSum(HE)
+	HE.Evaluator.Add(dist, RecordSlotRandomizer(recIdx, y.SlotPerCtx, HE), dist)
+	return dist
+}
+
+// Returns the |x - y| polynomial of the L1 distance
+// The polynomial evaluation does not rescale, the BGV noise (which grows multiplicatively
+// without rescaling) overflows the budget as soon as the polynomial has a multiplication.
+func l1AbsPoly(HE *HEHandler, maxVal int64) ([]uint64, error) {
+	if HE.Scheme == SCHEME_BGV && l1PolyDepth(maxVal) > 0 {
+		return nil, fmt.Errorf("%w: l1 distance with D > 2 requires the %v scheme", ErrParamMismatch, SCHEME_BFV)
+	}
+	return AbsPolyCoeffs(maxVal, HE.Params.T())
+}
+
+// L1 distance between the query and each record of the DB, the DB is not modified
+func L1Identification(HE *HEHandler, x *PlainStrip, maxVal int64, dbStrip []*CtxStrip) ([]*rlwe.Ciphertext, error) {
+	absPoly, err := l1AbsPoly(HE, maxVal)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*rlwe.Ciphertext, len(dbStrip))
+	for i := 0; i < len(dbStrip); i++ {
+		strip := dbStrip[i].CopyNew()
+		strip.absDiff(HE, x, absPoly)
+		out[i] = strip.StripeSum(HE)
+	}
+	return out, nil
+}
+
+// L1 distance between the query and the $recIdx'th record of the strip
+// All other slots are masked out (randomized). The strip is not modified.
+func L1Verify(HE *HEHandler, x *PlainStrip, maxVal int64, y *CtxStrip, recIdx int) (*rlwe.Ciphertext, error) {
+	absPoly, err := l1AbsPoly(HE, maxVal)
+	if err != nil {
+		return nil, err
+	}
+	strip := y.CopyNew()
+	strip.absDiff(HE, x, absPoly)
+	dist := strip.stripeSum(HE)
+	HE.Evaluator.Add(dist, RecordSlotRandomizer(recIdx, y.SlotPerCtx, HE), dist)
+	return dist, nil
+}
+
+// Masked (weighted) squared Euclidean distance between the query x and each record y of the DB
+// sum_i w_i.mx_i.my_i.(x_i - y_i)^2 = <w.x^2.mx, my> - 2<w.x.mx, y.my> + <w.mx, y^2.my>
+// The query is in plaintext: the distance only requires plaintext multiplications.
+// $weights may be nil (all weights are 1). The DB is not modified.
+func MaskedEuclideanIdentification(
+	HE *HEHandler,
+	x *PlainStrip, // query data
+	xmask *PlainStrip, // query mask
+	weights *PlainStrip, // per-feature weights
+	ymask []*CtxStrip, // ymask
+	y_dot_ymask []*CtxStrip, // y.(ymask)
+	y2_dot_ymask []*CtxStrip, // y^2.(ymask)
+) []*rlwe.Ciphertext {
+	a, b, c := maskedEucQuery(x, xmask, weights)
+	out := make([]*rlwe.Ciphertext, len(ymask))
+	for i := 0; i < len(ymask); i++ {
+		sum := maskedEucSum(HE, a, b, c, ymask[i].CopyNew(), y_dot_ymask[i].CopyNew(), y2_dot_ymask[i].CopyNew())
+		out[i] = sum.StripeSum(HE)
+	}
+	return out
+}
+
+// Masked distance between the query and the $recIdx'th record of a single strip
+// All other slots are masked out (randomized). The strips are not modified.
+func MaskedEucVerify(HE *HEHandler, x, xmask, weights *PlainStrip, ymask, y_dot_ymask, y2_dot_ymask *CtxStrip, recIdx int) *rlwe.Ciphertext {
+	a, b, c := maskedEucQuery(x, xmask, weights)
+	sum := maskedEucSum(HE, a, b, c, ymask.CopyNew(), y_dot_ymask.CopyNew(), y2_dot_ymask.CopyNew())
+	dist := sum.stripeSum(HE)
+	HE.Evaluator.Add(dist, RecordSlotRandomizer(recIdx, ymask.SlotPerCtx, HE), dist)
+	return dist
+}
+
+// Returns the query strips w.x^2.mx, -2w.x.mx and w.mx
+func maskedEucQuery(x, xmask, weights *PlainStrip) (a, b, c *PlainStrip) {
+	c = xmask
+	if weights != nil {
+		c = StripMul(xmask, weights)
+	}
+	b = StripMul(x, c)
+	a = StripMul(x, b)
+	b = b.Negate()
+	for i := range b.Strips {
+		for j := range b.Strips[i] {
+			b.Strips[i][j] *= 2
+		}
+	}
+	return a, b, c
+}
+
+// Computes a.ymask + b.y.ymask + c.y^2.ymask (in place in $ymask)
+func maskedEucSum(HE *HEHandler, a, b, c *PlainStrip, ymask, y_dot_ymask, y2_dot_ymask *CtxStrip) *CtxStrip {
+	ymask.Mul(HE, a)
+	y_dot_ymask.Mul(HE, b)
+	y2_dot_ymask.Mul(HE, c)
+	for k := 0; k < ymask.CtxPerTemplate; k++ {
+		HE.Evaluator.Add(ymask.Strips[k], y_dot_ymask.Strips[k], ymask.Strips[k])
+		HE.Evaluator.Add(ymask.Strips[k], y2_dot_ymask.Strips[k], ymask.Strips[k])
+	}
+	return ymask
+}
@@ -0,0 +1,56 @@
+package dedup
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// Finger parameters of the distance $dist (a small D keeps the |x - y| polynomial of L1 short)
+func fingerDistanceParams(dist string) *JanusParams {
+	bio := testParams("finger")
+	bio.Distance = dist
+	switch dist {
+	case DIST_WEIGHTED_EUCLIDEAN:
+		bio.FeatureWeights = NewRandomFeatureWeights(rand.New(rand.NewSource(2)), bio.TemplateSize, FEATURE_WEIGHT_MAX)
+	case DIST_L1:
+		bio.SensorD = 4
+	}
+	return bio
+}
+
+// Runs the identification twice and a verification against the same encrypted DB
+func checkRepeatedIdentification(t *testing.T, bpHE *HEHandler, janus *Janus, query *PlainBio) {
+	t.Helper()
+	checkIdentification(t, bpHE, janus, query)
+	checkIdentification(t, bpHE, janus, query)
+	encScore, err := janus.Verify(2, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := DecodeScores(janus.Params.BioType, []uint64{BPprocessVerifyReq(encScore, bpHE, janus.Params, 2)}, bpHE.Params.T())[0]
+	if want := janus.VerifyGroundTruth(2, query); got != want {
+		t.Errorf("Verify after the identifications: got score %v, want %v", got, want)
+	}
+}
+
+func TestFingerDistancesMatchGroundTruth(t *testing.T) {
+	for _, dist := range []string{DIST_WEIGHTED_EUCLIDEAN, DIST_L1} {
+		t.Run(dist, func(t *testing.T) {
+			bpHE, janus := newTestJanus(t, fingerDistanceParams(dist))
+			query := setupTestDB(t, janus)
+			checkRepeatedIdentification(t, bpHE, janus, query)
+		})
+	}
+}
+
+func TestMaskedEuclideanMatchesGroundTruth(t *testing.T) {
+	for _, dist := range []string{DIST_EUCLIDEAN, DIST_WEIGHTED_EUCLIDEAN} {
+		t.Run(dist, func(t *testing.T) {
+			bio := fingerDistanceParams(dist)
+			bio.SensorHasMask = true
+			bpHE, janus := newTestJanus(t, bio)
+			query := setupTestDB(t, janus)
+			checkRepeatedIdentification(t, bpHE, janus, query)
+		})
+	}
+}
@@ -2,32 +2,141 @@ package dedup
 
 import (
 	"fmt"
+	"math/rand"
 
+	"github.com/tuneinsight/lattigo/v4/bfv"
 	"github.com/tuneinsight/lattigo/v4/rlwe"
 )
 
 type JanusParams struct {
 	// Split each template between $CtxPerTemplate ciphertexts where each ciphertext contains
 	// $SlotsPerCtx slots of the template
-	// The template size must be equal to $CtxPerTemplate * $SlotsPerCtx
+	// The template size must be at most $CtxPerTemplate * $SlotsPerCtx, templates are zero padded
 	// The number of slots in a ciphertext must be a power of 2
 	CtxPerTemplate int
 	SlotsPerCtx    int
 	DbSize         int
 	Nbfv           int // number of slots in a ciphertext
 
+	// Merge the sparse outputs of the identification into fewer ciphertexts before the transfer
+	PackResults bool
+
 	// sensor params
 	BioType       string
 	TemplateSize  int
 	SensorD       int64
-	SensorHasMask bool
+	SensorHasMask bool // iris masks, or quality masks of finger templates
+
+	// finger distance (DIST_EUCLIDEAN if empty) and the per-feature weights of DIST_WEIGHTED_EUCLIDEAN
+	Distance       string
+	FeatureWeights []int64
 }
 
 func (bio JanusParams) Describe() string {
+	if bio.Distance != "" {
+		return fmt.Sprintf("DB[%v] templates from %v Sensor(%v, %v) with %v distance.\n",
+			bio.DbSize, bio.BioType, bio.TemplateSize, bio.SensorD, bio.Distance)
+	}
 	return fmt.Sprintf("DB[%v] templates from %v Sensor(%v, %v).\n",
 		bio.DbSize, bio.BioType, bio.TemplateSize, bio.SensorD)
 }
 
+// Checks that the biometric and strip parameters are consistent with the HE parameters
+// The errors wrap ErrParamMismatch, or ErrUnsupportedModality for an unknown BioType.
+func (bio JanusParams) Validate(params bfv.Parameters) error {
+	m, err := LookupModality(bio.BioType)
+	if err != nil {
+		return fmt.Errorf("Validate: %w", err)
+	}
+	if err := bio.validate(params); err != nil {
+		return fmt.Errorf("Validate: %w", err)
+	}
+	if err := m.ValidateParams(&bio); err != nil {
+		return fmt.Errorf("Validate: %w", err)
+	}
+	if err := bio.checkScoreRange(params.T()); err != nil {
+		return fmt.Errorf("Validate: %w", err)
+	}
+	if bio.PackResults {
+		// the masking of PackResults consumes a large part of the noise budget, the
+		// outputs would not decrypt correctly with parameters selected for the scores only
+		if err := bio.checkNoiseBudget(params); err != nil {
+			return fmt.Errorf("Validate: PackResults: %w", err)
+		}
+	}
+	return nil
+}
+
+func (bio JanusParams) validate(params bfv.Parameters) error {
+	if bio.DbSize <= 0 {
+		return paramMismatch("DbSize(%v) must be positive", bio.DbSize)
+	}
+	if bio.TemplateSize <= 0 {
+		return paramMismatch("TS(%v) must be positive", bio.TemplateSize)
+	}
+	if bio.SensorD < 2 || uint64(bio.SensorD) > params.T() {
+		return paramMismatch("D(%v) must be in [2, T=%v]", bio.SensorD, params.T())
+	}
+	if bio.Nbfv != params.N() {
+		return paramMismatch("Nbfv(%v) must be the number of slots N=%v", bio.Nbfv, params.N())
+	}
+	// the inner sum rotates the rows of N/2 slots
+	if bio.SlotsPerCtx <= 0 || !IsPowerOf2(bio.SlotsPerCtx) || bio.SlotsPerCtx > bio.Nbfv/2 {
+		return paramMismatch("SlotsPerCtx(%v) must be a power of 2 in [1, N/2=%v]", bio.SlotsPerCtx, bio.Nbfv/2)
+	}
+	if bio.CtxPerTemplate <= 0 || bio.TemplateSize > bio.CtxPerTemplate*bio.SlotsPerCtx {
+		return paramMismatch("TS(%v) > CtxPerTemplate(%v)*SlotsPerCtx(%v)", bio.TemplateSize, bio.CtxPerTemplate, bio.SlotsPerCtx)
+	}
+	return nil
+}
+
+// Number of strips needed to store the DB, i.e., the number of outputs of the identification
+func (bio JanusParams) NumStrips() int {
+	recPerCtx := bio.Nbfv / bio.SlotsPerCtx
+	return (bio.DbSize + recPerCtx - 1) / recPerCtx
+}
+
+// Number of ciphertexts returned by the identification (after PackResults)
+func (bio JanusParams) NumOutputs() int {
+	if bio.PackResults {
+		return (bio.NumStrips() + bio.SlotsPerCtx - 1) / bio.SlotsPerCtx
+	}
+	return bio.NumStrips()
+}
+
+// Rotations performed by InnerSum(ctx, 1, SlotsPerCtx)
+// SlotsPerCtx is a power of two: the inner sum only rotates by 1, 2, ..., SlotsPerCtx/2
+// (params.RotationsForInnerSum also lists rotations only needed for other sizes)
+func (bio JanusParams) innerSumRotations() []int {
+	rotations := []int{}
+	for k := 1; k < bio.SlotsPerCtx; k *= 2 {
+		rotations = append(rotations, k)
+	}
+	return rotations
+}
+
+// Returns the sorted Galois elements of the rotations performed by the identification
+// StripeSum (identification and verification) computes InnerSum(ctx, 1, SlotsPerCtx) and
+// PackResults rotates the j'th output of each group by -j columns with a single key switch.
+func (bio JanusParams) GaloisElements(params bfv.Parameters) []uint64 {
+	rotations := bio.innerSumRotations()
+	if bio.PackResults {
+		for j := 1; j < bio.SlotsPerCtx; j++ {
+			rotations = append(rotations, -j)
+		}
+	}
+
+	galEls := make(map[uint64]bool)
+	for _, rot := range rotations {
+		galEls[params.GaloisElementForColumnRotationBy(rot)] = true
+	}
+	out := make([]uint64, 0, len(galEls))
+	for galEl := range galEls {
+		out = append(out, galEl)
+	}
+	return sortedGaloisElements(out)
+}
+
 // The RS component of Hyb-Janus
 // This component only include the SHE distance computation portion of Hyb-Janus
 // To check the SMC thresholding portion of Hyb-Janus, check smc/bio_dedup/hyb_threshold.cpp
@@ -37,117 +146,126 @@ type Janus struct {
 
 	db    []*PlainBio
 	encDB *EncryptedDB
+
+	seededEnc *SeededEncryptor // if set, the DB is encrypted with the seeded symmetric encryptor
+}
+
+// Returns the Janus instance of the registration station holding $he
+// The parameters are validated against the HE parameters, see JanusParams.Validate.
+func NewJanus(params *JanusParams, he *HEHandler) (*Janus, error) {
+	if err := params.Validate(he.Params); err != nil {
+		return nil, fmt.Errorf("NewJanus: %w", err)
+	}
+	return &Janus{Params: params, HE: he}, nil
 }
 
 type EncryptedDB struct {
 	bioType string
+	seed    []byte // seed of the seeded encryptor, nil if encrypted with the public key
 
-	fingerCtxStrip []*CtxStrip
+	keyEpoch int // epoch of the BP key encrypting the DB
 
-	irisMaskCtxStrip     []*CtxStrip
-	irisYMaskCtxStrip    []*CtxStrip
-	irisYBarMaskCtxStrip []*CtxStrip
+	// strips[i] holds the Modality.NumComponents(bio) encrypted components of the i'th strip
+	strips [][]*CtxStrip
 }
 
 // Generates random data for the user template database
-func (janus *Janus) GenerateUserDB() {
+func (janus *Janus) GenerateUserDB(rng *rand.Rand) {
 	janus.db = make([]*PlainBio, janus.Params.DbSize)
 	for i := range janus.db {
-		janus.db[i] = NewRandomPlainBio(janus.Params)
+		janus.db[i] = NewRandomPlainBio(rng, janus.Params)
 	}
 }
 
 // Returns a bio template that matches user db[matchIdx]
-func (janus *Janus) GenerateMatchingQuery(matchIdx int) *PlainBio {
-	return janus.db[matchIdx].CreateFakeMatch(0.9)
+func (janus *Janus) GenerateMatchingQuery(rng *rand.Rand, matchIdx int) *PlainBio {
+	return janus.db[matchIdx].CreateFakeMatch(rng, 0.9)
 }
 
-// Compute the identification distance using the plain database (ground truth)
+// Compute the identification scores using the plain database (ground truth)
+// The scores are the plaintext references of the encrypted scores of the modality (e.g., the
+// signed normalized Hamming distance score for iris) and can be compared with CheckAnswer.
 func (janus *Janus) IdentificationGroundTruth(query *PlainBio) (answer []int64) {
 	answer = make([]int64, janus.Params.DbSize)
 	for i := range answer {
-		answer[i] = query.ComputeDist(janus.db[i])
+		answer[i] = janus.Params.ComputeScore(query, janus.db[i])
 	}
 	return answer
 }
 
-func (janus *Janus) EncryptDatabase() error {
-	if janus.Params.BioType == "finger" {
-		return janus.EncryptFingerDatabase()
-	} else if janus.Params.BioType == "iris" {
-		return janus.EncryptIrisDatabase()
-	} else {
-		fmt.Printf("BioType %v not supported.\n", janus.Params.BioType)
-		return fmt.Errorf("BioType %v not supported.\n", janus.Params.BioType)
-	}
+// Compute the verification score using the plain database (ground truth)
+func (janus *Janus) VerifyGroundTruth(userID int, query *PlainBio) int64 {
+	return janus.Params.ComputeScore(query, janus.db[userID])
 }
-func (janus *Janus) EncryptFingerDatabase() error {
-	// plaintext strips
-	records := make([][]int64, len(janus.db))
-	for i := 0; i < len(janus.db); i++ {
-		records[i] = janus.db[i].Data
-	}
-	dbPlainStrips, err := StripRecords(janus.Params, records)
-	if err != nil {
-		return fmt.Errorf("DB packing failed: %v.\n", err)
-	}
 
-	// encrypt strips
-	dbCtxStrips := make([]*CtxStrip, len(dbPlainStrips))
-	for i := 0; i < len(dbPlainStrips); i++ {
-		dbCtxStrips[i], err = dbPlainStrips[i].Encrypt(janus.HE)
-		if err != nil {
-			return fmt.Errorf("DB encryption error: %v.\n", err)
-		}
-	}
-	janus.encDB = &EncryptedDB{
-		bioType:        "finger",
-		fingerCtxStrip: dbCtxStrips,
+// Checks that the worst-case score fits in the plaintext modulus T
+// Larger scores silently wrap around modulo T in the encrypted result.
+func (janus *Janus) CheckScoreRange() error {
+	return janus.Params.checkScoreRange(janus.HE.Params.T())
+}
+
+func (bio JanusParams) checkScoreRange(T uint64) error {
+	low, high := bio.ScoreRange()
+	if minT := bio.MinPlaintextModulus(); T < minT {
+		return paramMismatch("scores of %v Sensor(%v, %v) in [%v, %v] overflow the plaintext modulus T=%v (requires T >= %v)",
+			bio.BioType, bio.TemplateSize, bio.SensorD, low, high, T, minT)
 	}
 	return nil
 }
 
-func (janus *Janus) EncryptIrisDatabase() error {
-	records_y := make([][]int64, len(janus.db))
-	records_mask := make([][]int64, len(janus.db))
-	for i := 0; i < len(janus.db); i++ {
-		records_y[i] = janus.db[i].Data
-		records_mask[i] = janus.db[i].Mask
+func (janus *Janus) EncryptDatabase() error {
+	if err := janus.CheckScoreRange(); err != nil {
+		return err
 	}
-
-	yStrips, err := StripRecords(janus.Params, records_y)
+	m, err := LookupModality(janus.Params.BioType)
 	if err != nil {
-		return fmt.Errorf("DB packing y failed: %v.\n", err)
+		return err
 	}
 
-	maskStrips, err := StripRecords(janus.Params, records_mask)
+	// plaintext strips
+	dbPlainStrips, err := m.PackDB(janus.Params, janus.db)
 	if err != nil {
-		return fmt.Errorf("DB packing mask failed: %v.\n", err)
+		return err
 	}
 
 	// encrypt strips
-	irisMaskCtxStrip := make([]*CtxStrip, len(yStrips))
-	irisYMaskCtxStrip := make([]*CtxStrip, len(yStrips))
-	irisYBarMaskCtxStrip := make([]*CtxStrip, len(yStrips))
-	for i := 0; i < len(yStrips); i++ {
-		irisMaskCtxStrip[i], err = maskStrips[i].Encrypt(janus.HE)
-		if err != nil {
-			return fmt.Errorf("DB encryption error mask: %v.\n", err)
-		}
-		irisYMaskCtxStrip[i], err = (StripMul(maskStrips[i], yStrips[i])).Encrypt(janus.HE)
-		if err != nil {
-			return fmt.Errorf("DB encryption error Y.Mask: %v.\n", err)
-		}
-		irisYBarMaskCtxStrip[i], err = (StripMul(maskStrips[i], yStrips[i].LogicNot())).Encrypt(janus.HE)
-		if err != nil {
-			return fmt.Errorf("DB encryption error Ybar.mask: %v.\n", err)
+	dbCtxStrips := make([][]*CtxStrip, len(dbPlainStrips))
+	for i := range dbPlainStrips {
+		dbCtxStrips[i] = make([]*CtxStrip, len(dbPlainStrips[i]))
+		for k := range dbPlainStrips[i] {
+			dbCtxStrips[i][k], err = janus.encryptStrip(dbPlainStrips[i][k])
+			if err != nil {
+				return fmt.Errorf("EncryptDatabase: %w", err)
+			}
 		}
 	}
 	janus.encDB = &EncryptedDB{
-		bioType:              "iris",
-		irisMaskCtxStrip:     irisMaskCtxStrip,
-		irisYMaskCtxStrip:    irisYMaskCtxStrip,
-		irisYBarMaskCtxStrip: irisYBarMaskCtxStrip,
+		bioType:  m.Name(),
+		seed:     janus.encryptionSeed(),
+		keyEpoch: janus.HE.Epoch,
+		strips:   dbCtxStrips,
+	}
+	return nil
+}
+
+// Encrypts the database with a seeded symmetric encryptor (e.g., an enrollment device holding the key)
+// The encrypted DB can then be serialized compactly with MarshalSeededDatabase.
+func (janus *Janus) EncryptDatabaseSeeded(enc *SeededEncryptor) error {
+	janus.seededEnc = enc
+	defer func() { janus.seededEnc = nil }()
+	return janus.EncryptDatabase()
+}
+
+func (janus *Janus) encryptStrip(strip *PlainStrip) (*CtxStrip, error) {
+	if janus.seededEnc != nil {
+		return janus.seededEnc.EncryptStrip(strip), nil
+	}
+	return strip.Encrypt(janus.HE)
+}
+
+func (janus *Janus) encryptionSeed() []byte {
+	if janus.seededEnc != nil {
+		return janus.seededEnc.Seed
 	}
 	return nil
 }
@@ -156,40 +274,54 @@ func (janus *Janus) EncryptIrisDatabase() error {
 // This function computes the distance between the query and the database in cipher domain.
 // In Hyb-Janus, the registration station secret shares this encrypted distance (using additive
 // secret sharing) and sends the encypted share to the biometric provider who holds the key.
-func (janus *Janus) Identification(query *PlainBio) (PackedEncDist []*rlwe.Ciphertext) {
-	if janus.Params.BioType == "finger" {
-		return janus.ComputeEucDist(query)
-	} else if janus.Params.BioType == "iris" {
-		return janus.ComputeNormHamDist(query)
-	} else {
-		fmt.Printf("BioType %v not supported.\n", janus.Params.BioType)
-		return nil
+func (janus *Janus) Identification(query *PlainBio) ([]*rlwe.Ciphertext, error) {
+	if err := janus.CheckScoreRange(); err != nil {
+		return nil, fmt.Errorf("Identification: %w", err)
 	}
-}
-
-func (janus *Janus) ComputeEucDist(query *PlainBio) (PackedEncDist []*rlwe.Ciphertext) {
-	queryPtxStrip, err := ReplicateAsStripeRecords(janus.Params, query.Data)
+	if err := janus.checkKeyEpoch(); err != nil {
+		return nil, fmt.Errorf("Identification: %w", err)
+	}
+	m, err := LookupModality(janus.Params.BioType)
+	if err != nil {
+		return nil, err
+	}
+	queryStrips, err := m.PackQuery(janus.Params, query)
+	if err != nil {
+		return nil, err
+	}
+	PackedEncDist, err := m.Identification(janus.HE, janus.Params, queryStrips, janus.encDB.strips)
 	if err != nil {
-		fmt.Printf("Query packing failed: %v.\n", err)
-		return
+		return nil, fmt.Errorf("Identification: %w", err)
 	}
-	PackedEncDist = queryPtxStrip.EuclideanIdentification(janus.HE, janus.encDB.fingerCtxStrip)
-	return PackedEncDist
+	if janus.Params.PackResults {
+		PackedEncDist = PackResults(janus.HE, PackedEncDist, janus.Params.SlotsPerCtx)
+	}
+	return PackedEncDist, nil
 }
 
-func (janus *Janus) ComputeNormHamDist(query *PlainBio) (PackedEncDist []*rlwe.Ciphertext) {
-	xStrip, err := ReplicateAsStripeRecords(janus.Params, query.Data)
-	if err != nil {
-		fmt.Printf("Query packing data failed: %v.\n", err)
-		return
+// 1:1 verification of the query against the $userID'th user of the database
+// Only the strip holding the user is processed and the slots of all other users
+// are masked out before sending the result to the biometric provider.
+func (janus *Janus) Verify(userID int, query *PlainBio) (*rlwe.Ciphertext, error) {
+	if userID < 0 || userID >= janus.Params.DbSize {
+		return nil, fmt.Errorf("Verify: user %v not in DB[%v]", userID, janus.Params.DbSize)
 	}
+	if err := janus.CheckScoreRange(); err != nil {
+		return nil, fmt.Errorf("Verify: %w", err)
+	}
+	if err := janus.checkKeyEpoch(); err != nil {
+		return nil, fmt.Errorf("Verify: %w", err)
+	}
+	recPerCtx := janus.Params.Nbfv / janus.Params.SlotsPerCtx
+	stripIdx, recIdx := userID/recPerCtx, userID%recPerCtx
 
-	maskStrip, err := ReplicateAsStripeRecords(janus.Params, query.Mask)
+	m, err := LookupModality(janus.Params.BioType)
 	if err != nil {
-		fmt.Printf("Query packing mask failed: %v.\n", err)
-		return
+		return nil, err
 	}
-
-	PackedEncDist = NHammingDistance(janus.HE, xStrip, maskStrip, janus.encDB.irisYMaskCtxStrip, janus.encDB.irisYBarMaskCtxStrip, janus.encDB.irisMaskCtxStrip)
-	return PackedEncDist
+	queryStrips, err := m.PackQuery(janus.Params, query)
+	if err != nil {
+		return nil, err
+	}
+	return m.Verify(janus.HE, janus.Params, queryStrips, janus.encDB.strips[stripIdx], recIdx)
 }
@@ -0,0 +1,163 @@
+package dedup
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/tuneinsight/lattigo/v4/bfv"
+)
+
+// Small parameters of each modality for the encrypted tests
+func testParams(bioType string) *JanusParams {
+	bio := &JanusParams{DbSize: 40, BioType: bioType, TemplateSize: 64, SlotsPerCtx: 4, CtxPerTemplate: 16}
+	switch bioType {
+	case "finger":
+		bio.SensorD = 256
+	case "iris":
+		bio.SensorD = 2
+		bio.SensorHasMask = true
+	case "face":
+		bio.SensorD = 128
+	}
+	return bio
+}
+
+// Selects the HE parameters of $bio and returns the BP handler (with the secret key)
+// and the Janus instance of the RS holding the public handler
+func newTestJanus(t *testing.T, bio *JanusParams) (*HEHandler, *Janus) {
+	t.Helper()
+	return newTestJanusScheme(t, bio, SCHEME_BFV)
+}
+
+// Same as newTestJanus with the SHE $scheme
+func newTestJanusScheme(t *testing.T, bio *JanusParams, scheme string) (*HEHandler, *Janus) {
+	t.Helper()
+	params, err := SelectBFVParams(bio, Classical128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bio.Nbfv = params.N()
+	bpHE := &HEHandler{Scheme: scheme}
+	if err := bpHE.KeyGenForJanus(params, bio); err != nil {
+		t.Fatal(err)
+	}
+	janus, err := NewJanus(bio, bpHE.GetPublicHandler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bpHE, janus
+}
+
+// Generates the DB and a query matching the user 2, and encrypts the DB
+func setupTestDB(t *testing.T, janus *Janus) *PlainBio {
+	t.Helper()
+	rng := rand.New(rand.NewSource(1))
+	janus.GenerateUserDB(rng)
+	query := janus.GenerateMatchingQuery(rng, 2)
+	if err := janus.EncryptDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	return query
+}
+
+// Runs the identification and checks the decrypted scores against the ground truth modulo T
+func checkIdentification(t *testing.T, bpHE *HEHandler, janus *Janus, query *PlainBio) {
+	t.Helper()
+	encDist, err := janus.Identification(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, err := BPprocessJanusIdReq(encDist, bpHE, janus.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckAnswer(answer, janus.IdentificationGroundTruth(query), bpHE.Params.T()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIdentificationMatchesGroundTruth(t *testing.T) {
+	for _, bioType := range []string{"finger", "iris", "face"} {
+		t.Run(bioType, func(t *testing.T) {
+			bpHE, janus := newTestJanus(t, testParams(bioType))
+			query := setupTestDB(t, janus)
+			checkIdentification(t, bpHE, janus, query)
+		})
+	}
+}
+
+func TestVerifyMatchesGroundTruth(t *testing.T) {
+	for _, bioType := range []string{"finger", "iris", "face"} {
+		t.Run(bioType, func(t *testing.T) {
+			bpHE, janus := newTestJanus(t, testParams(bioType))
+			query := setupTestDB(t, janus)
+			for _, userID := range []int{0, 2, janus.Params.DbSize - 1} {
+				encScore, err := janus.Verify(userID, query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := DecodeScores(bioType, []uint64{BPprocessVerifyReq(encScore, bpHE, janus.Params, userID)}, bpHE.Params.T())[0]
+				if want := janus.VerifyGroundTruth(userID, query); got != want {
+					t.Errorf("user %v: got score %v, want %v", userID, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckAnswer(t *testing.T) {
+	const T = 97
+	tests := []struct {
+		name        string
+		answer      []uint64
+		groundTruth []int64
+		wantErr     bool
+	}{
+		{"equal", []uint64{1, 2, 3}, []int64{1, 2, 3}, false},
+		{"negative scores mod T", []uint64{T - 1, 0}, []int64{-1, 0}, false},
+		{"wrap-around", []uint64{3}, []int64{T + 3}, false},
+		{"extra answers ignored", []uint64{1, 2, 50}, []int64{1, 2}, false},
+		{"mismatch", []uint64{1, 5}, []int64{1, 2}, true},
+		{"missing answers", []uint64{1}, []int64{1, 2}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckAnswer(tt.answer, tt.groundTruth, T)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CheckAnswer(%v, %v) error = %v, wantErr %v", tt.answer, tt.groundTruth, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestScoreRangeOverflow(t *testing.T) {
+	// FingerSensor(640, 256): the max distance 640*255^2 overflows T = 65537
+	bio := testParams("finger")
+	bio.TemplateSize, bio.CtxPerTemplate = 640, 160
+	pl := bfv.PN12QP109
+	pl.T = 65537
+	params, err := bfv.NewParametersFromLiteral(pl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bio.Nbfv = params.N()
+	if err := bio.Validate(params); !errors.Is(err, ErrParamMismatch) {
+		t.Errorf("Validate: got %v, want ErrParamMismatch", err)
+	}
+
+	// the checks of EncryptDatabase, Identification and Verify when the parameters change
+	// after the construction
+	bpHE, janus := newTestJanus(t, testParams("finger"))
+	query := setupTestDB(t, janus)
+	janus.Params.SensorD = int64(bpHE.Params.T())
+	if err := janus.EncryptDatabase(); !errors.Is(err, ErrParamMismatch) {
+		t.Errorf("EncryptDatabase: got %v, want ErrParamMismatch", err)
+	}
+	if _, err := janus.Identification(query); !errors.Is(err, ErrParamMismatch) {
+		t.Errorf("Identification: got %v, want ErrParamMismatch", err)
+	}
+	if _, err := janus.Verify(0, query); !errors.Is(err, ErrParamMismatch) {
+		t.Errorf("Verify: got %v, want ErrParamMismatch", err)
+	}
+}
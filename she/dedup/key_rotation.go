@@ -0,0 +1,109 @@
+package dedup
+
+import (
+	"fmt"
+
+	"github.com/tuneinsight/lattigo/v4/bfv"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// Base (in bits) of the additional power-of-two gadget decomposition of the key rotation
+// The finer decomposition doubles the switching key size but the key switched DB keeps
+// almost the noise of a fresh encryption: with the default decomposition (RNS only), the
+// key switching noise consumes most of the budget of the identification circuit.
+const KEY_ROTATION_POW2_BASE = 24
+
+// Parameters used to generate and apply the key rotation switching key
+func keyRotationParams(params bfv.Parameters) (bfv.Parameters, error) {
+	lit := params.ParametersLiteral()
+	lit.Pow2Base = KEY_ROTATION_POW2_BASE
+	return bfv.NewParametersFromLiteral(lit)
+}
+
+// Switching key from the BP secret key of epoch $FromEpoch to the one of epoch $ToEpoch
+// The BP sends it to the RS, which key switches the stored DB instead of re-encrypting it
+// from the plaintext templates.
+type KeyRotation struct {
+	FromEpoch    int
+	ToEpoch      int
+	SwitchingKey *rlwe.SwitchingKey
+}
+
+// Rotates the BP key: generates a fresh key pair and evaluation keys for $bio, and returns
+// the switching key from the previous secret key to the new one.
+// The handler moves to the next key epoch, the previous secret key is discarded.
+func (he *HEHandler) RotateKey(bio *JanusParams) (*KeyRotation, error) {
+	if he.SecretKey == nil {
+		return nil, fmt.Errorf("RotateKey: the handler does not hold the secret key")
+	}
+	params := he.Params
+	rotParams, err := keyRotationParams(params)
+	if err != nil {
+		return nil, fmt.Errorf("RotateKey: %w", err)
+	}
+	oldSk, epoch := he.SecretKey, he.Epoch
+
+	kgen := bfv.NewKeyGenerator(params)
+	sk, pk := kgen.GenKeyPair()
+	evk := rlwe.EvaluationKey{
+		Rlk:  kgen.GenRelinearizationKey(sk, 2),
+		Rtks: kgen.GenRotationKeys(bio.GaloisElements(params), sk),
+	}
+	rot := &KeyRotation{
+		FromEpoch:    epoch,
+		ToEpoch:      epoch + 1,
+		SwitchingKey: bfv.NewKeyGenerator(rotParams).GenSwitchingKey(oldSk, sk),
+	}
+
+	if err := he.SetKeys(params, sk, pk, evk); err != nil {
+		return nil, fmt.Errorf("RotateKey: %w", err)
+	}
+	he.Epoch = rot.ToEpoch
+	return rot, nil
+}
+
+// Key switches every ciphertext of the encrypted DB with $rot and moves the RS to $newHE,
+// the public handler of the new BP key.
+// The DB must be encrypted under the key of epoch rot.FromEpoch. After the rotation, the
+// DB can no longer be serialized with MarshalSeededDatabase (c1 is not seeded anymore).
+func (janus *Janus) RotateDBKey(rot *KeyRotation, newHE *HEHandler) error {
+	if janus.encDB == nil {
+		return fmt.Errorf("RotateDBKey: the DB is not encrypted")
+	}
+	if janus.encDB.keyEpoch != rot.FromEpoch {
+		return fmt.Errorf("RotateDBKey: %w", paramMismatch("the DB is encrypted under key epoch %v, the rotation is from epoch %v",
+			janus.encDB.keyEpoch, rot.FromEpoch))
+	}
+	if newHE.Epoch != rot.ToEpoch {
+		return fmt.Errorf("RotateDBKey: %w", paramMismatch("the new handler has key epoch %v, the rotation is to epoch %v",
+			newHE.Epoch, rot.ToEpoch))
+	}
+
+	rotParams, err := keyRotationParams(janus.HE.Params)
+	if err != nil {
+		return fmt.Errorf("RotateDBKey: %w", err)
+	}
+	// the key switching is the same for BFV and BGV ciphertexts
+	evaluator := rlwe.NewEvaluator(rotParams.Parameters, nil)
+	for _, strip := range janus.encDB.orderedStrips() {
+		for _, ctx := range strip.Strips {
+			evaluator.SwitchKeys(ctx, rot.SwitchingKey, ctx)
+		}
+	}
+	janus.encDB.keyEpoch = rot.ToEpoch
+	janus.encDB.seed = nil
+	janus.HE = newHE
+	return nil
+}
+
+// Rejects an encrypted DB whose key epoch is not the one of the RS handler
+func (janus *Janus) checkKeyEpoch() error {
+	if janus.encDB == nil {
+		return fmt.Errorf("the DB is not encrypted")
+	}
+	if janus.encDB.keyEpoch != janus.HE.Epoch {
+		return paramMismatch("stale encrypted DB: encrypted under key epoch %v, current key epoch is %v",
+			janus.encDB.keyEpoch, janus.HE.Epoch)
+	}
+	return nil
+}
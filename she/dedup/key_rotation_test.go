@@ -0,0 +1,43 @@
+package dedup
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRotateDBKey(t *testing.T) {
+	for _, scheme := range []string{SCHEME_BFV, SCHEME_BGV} {
+		t.Run(scheme, func(t *testing.T) {
+			bpHE, janus := newTestJanusScheme(t, testParams("finger"), scheme)
+			query := setupTestDB(t, janus)
+			rot, err := bpHE.RotateKey(janus.Params)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the DB is still encrypted under the previous key
+			oldHE := janus.HE
+			janus.HE = bpHE.GetPublicHandler()
+			if _, err := janus.Identification(query); !errors.Is(err, ErrParamMismatch) {
+				t.Errorf("Identification of a stale DB: got %v, want ErrParamMismatch", err)
+			}
+			if _, err := janus.Verify(2, query); !errors.Is(err, ErrParamMismatch) {
+				t.Errorf("Verify of a stale DB: got %v, want ErrParamMismatch", err)
+			}
+			janus.HE = oldHE
+			if err := janus.RotateDBKey(rot, oldHE); !errors.Is(err, ErrParamMismatch) {
+				t.Errorf("RotateDBKey to the previous handler: got %v, want ErrParamMismatch", err)
+			}
+
+			if err := janus.RotateDBKey(rot, bpHE.GetPublicHandler()); err != nil {
+				t.Fatal(err)
+			}
+			// decrypted with the new secret key
+			checkRepeatedIdentification(t, bpHE, janus, query)
+
+			if err := janus.RotateDBKey(rot, bpHE.GetPublicHandler()); !errors.Is(err, ErrParamMismatch) {
+				t.Errorf("RotateDBKey of a rotated DB: got %v, want ErrParamMismatch", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,431 @@
+package dedup
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// A biometric modality of the integer (BFV/BGV) identification
+// Janus only handles the modality through this interface: a new modality is added by
+// implementing it and registering it with RegisterModality, the modality is then
+// selected by JanusParams.BioType.
+//
+// The DB of a modality is stored as several components, e.g., iris stores the mask, y.mask
+// and ~y.mask of each record. PackDB returns, for each strip of records, the NumComponents(bio)
+// plaintext strips that are encrypted by Janus.
+type Modality interface {
+	Name() string
+	// The templates always have a mask (optional masks are enabled by JanusParams.SensorHasMask)
+	HasMask() bool
+	// Signed scores are decoded from [0, T) as values in (-T/2, T/2]
+	SignedScore() bool
+	NumComponents(bio *JanusParams) int
+	// Checks the parameters specific to the modality (masks, domain, distance)
+	ValidateParams(bio *JanusParams) error
+
+	// Range [low, high] of the score computed by the identification
+	ScoreRange(bio JanusParams) (low, high int64)
+
+	// Random template generator
+	NewRandom(rng *rand.Rand, bio *JanusParams) *PlainBio
+	CreateFakeMatch(rng *rand.Rand, base *PlainBio, similarity float32) *PlainBio
+
+	// Plaintext reference of the encrypted score, lower scores are better matches
+	Score(params *JanusParams, query, target *PlainBio) int64
+
+	PackDB(params *JanusParams, db []*PlainBio) ([][]*PlainStrip, error)
+	PackQuery(params *JanusParams, query *PlainBio) ([]*PlainStrip, error)
+
+	// Encrypted scores of the query against each strip of the DB, db[i] holds the
+	// components of the i'th strip
+	Identification(HE *HEHandler, params *JanusParams, query []*PlainStrip, db [][]*CtxStrip) ([]*rlwe.Ciphertext, error)
+	// Encrypted score of the query against the $recIdx'th record of a single strip
+	// All other slots are masked out (randomized). The strip is not modified.
+	Verify(HE *HEHandler, params *JanusParams, query []*PlainStrip, strip []*CtxStrip, recIdx int) (*rlwe.Ciphertext, error)
+}
+
+var modalities = make(map[string]Modality)
+
+// Registers a modality under its name, panics if the name is already registered
+func RegisterModality(m Modality) {
+	if _, ok := modalities[m.Name()]; ok {
+		panic(fmt.Sprintf("RegisterModality: modality %v already registered", m.Name()))
+	}
+	modalities[m.Name()] = m
+}
+
+func LookupModality(name string) (Modality, error) {
+	m, ok := modalities[name]
+	if !ok {
+		return nil, fmt.Errorf("BioType %v: %w", name, ErrUnsupportedModality)
+	}
+	return m, nil
+}
+
+// Returns the sorted names of the registered modalities
+func ModalityNames() []string {
+	names := make([]string, 0, len(modalities))
+	for name := range modalities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterModality(fingerModality{})
+	RegisterModality(irisModality{})
+	RegisterModality(faceModality{})
+}
+
+// Returns the $k'th component of each strip of the DB
+func stripComponent(db [][]*CtxStrip, k int) []*CtxStrip {
+	out := make([]*CtxStrip, len(db))
+	for i := range db {
+		out[i] = db[i][k]
+	}
+	return out
+}
+
+// Packs the template values (without mask) of the DB, one component per strip
+func packDBData(params *JanusParams, db []*PlainBio) ([][]*PlainStrip, error) {
+	records := make([][]int64, len(db))
+	for i := 0; i < len(db); i++ {
+		records[i] = db[i].Data
+	}
+	strips, err := StripRecords(params, records)
+	if err != nil {
+		return nil, &PackingError{What: "DB", Err: err}
+	}
+	out := make([][]*PlainStrip, len(strips))
+	for i := range strips {
+		out[i] = []*PlainStrip{strips[i]}
+	}
+	return out, nil
+}
+
+func packQueryData(params *JanusParams, query *PlainBio) ([]*PlainStrip, error) {
+	xStrip, err := ReplicateAsStripeRecords(params, query.Data)
+	if err != nil {
+		return nil, &PackingError{What: "Query", Err: err}
+	}
+	return []*PlainStrip{xStrip}, nil
+}
+
+// finger: distance between templates of TS values in [0, D)
+// The distance is selected by JanusParams.Distance: squared Euclidean (default), weighted
+// squared Euclidean or L1, see finger_dist.go.
+// With quality masks (JanusParams.SensorHasMask), only the features valid in both templates
+// contribute to the distance. The DB components are then the mask, y.mask and y^2.mask of
+// each record.
+type fingerModality struct{}
+
+func (fingerModality) Name() string      { return "finger" }
+func (fingerModality) HasMask() bool     { return false }
+func (fingerModality) SignedScore() bool { return false }
+
+func (fingerModality) NumComponents(bio *JanusParams) int {
+	if bio.SensorHasMask {
+		return 3
+	}
+	return 1
+}
+
+// Finger masks are optional, the distance must support them
+func (fingerModality) ValidateParams(bio *JanusParams) error {
+	_, err := bio.fingerDistance()
+	return err
+}
+
+// euclidean: [0, TS*(D-1)^2]
+// weighted: [0, sum(w)*(D-1)^2]
+// l1: [0, TS*(D-1)]
+func (fingerModality) ScoreRange(bio JanusParams) (low, high int64) {
+	ts := int64(bio.TemplateSize)
+	switch bio.Distance {
+	case DIST_WEIGHTED_EUCLIDEAN:
+		sum := int64(0)
+		for _, w := range bio.FeatureWeights {
+			sum += w
+		}
+		return 0, sum * (bio.SensorD - 1) * (bio.SensorD - 1)
+	case DIST_L1:
+		return 0, ts * (bio.SensorD - 1)
+	}
+	return 0, ts * (bio.SensorD - 1) * (bio.SensorD - 1)
+}
+
+func (fingerModality) NewRandom(rng *rand.Rand, bio *JanusParams) *PlainBio {
+	return newRandomIntBio(rng, bio)
+}
+
+func (fingerModality) CreateFakeMatch(rng *rand.Rand, base *PlainBio, similarity float32) *PlainBio {
+	return createFakeIntMatch(rng, base, similarity)
+}
+
+func (fingerModality) Score(params *JanusParams, query, target *PlainBio) int64 {
+	x, y := query.Data, target.Data
+	if query.HasMask && target.HasMask {
+		mask := MergeMask(query.Mask, target.Mask)
+		x, y = ApplyMask(x, mask), ApplyMask(y, mask)
+	}
+	switch params.Distance {
+	case DIST_WEIGHTED_EUCLIDEAN:
+		return DistWeightedEuclidean(x, y, params.FeatureWeights)
+	case DIST_L1:
+		return DistManhattan(x, y)
+	}
+	return DistEuclidean(x, y)
+}
+
+func (fingerModality) PackDB(params *JanusParams, db []*PlainBio) ([][]*PlainStrip, error) {
+	if _, err := params.fingerDistance(); err != nil {
+		return nil, err
+	}
+	if !params.SensorHasMask {
+		return packDBData(params, db)
+	}
+
+	records_y := make([][]int64, len(db))
+	records_mask := make([][]int64, len(db))
+	for i := 0; i < len(db); i++ {
+		records_y[i] = db[i].Data
+		records_mask[i] = db[i].Mask
+	}
+	yStrips, err := StripRecords(params, records_y)
+	if err != nil {
+		return nil, &PackingError{What: "DB y", Err: err}
+	}
+	maskStrips, err := StripRecords(params, records_mask)
+	if err != nil {
+		return nil, &PackingError{What: "DB mask", Err: err}
+	}
+
+	out := make([][]*PlainStrip, len(yStrips))
+	for i := range yStrips {
+		yMask := StripMul(maskStrips[i], yStrips[i])
+		out[i] = []*PlainStrip{maskStrips[i], yMask, StripMul(yMask, yStrips[i])}
+	}
+	return out, nil
+}
+
+// The query components are x, the mask of x with quality masks, and the weights for the
+// weighted distance
+func (fingerModality) PackQuery(params *JanusParams, query *PlainBio) ([]*PlainStrip, error) {
+	dist, err := params.fingerDistance()
+	if err != nil {
+		return nil, err
+	}
+	strips, err := packQueryData(params, query)
+	if err != nil {
+		return nil, err
+	}
+	if params.SensorHasMask {
+		maskStrip, err := ReplicateAsStripeRecords(params, query.Mask)
+		if err != nil {
+			return nil, &PackingError{What: "Query mask", Err: err}
+		}
+		strips = append(strips, maskStrip)
+	}
+	if dist == DIST_WEIGHTED_EUCLIDEAN {
+		wStrip, err := ReplicateAsStripeRecords(params, params.FeatureWeights)
+		if err != nil {
+			return nil, &PackingError{What: "Weights", Err: err}
+		}
+		strips = append(strips, wStrip)
+	}
+	return strips, nil
+}
+
+func (fingerModality) Identification(HE *HEHandler, params *JanusParams, query []*PlainStrip, db [][]*CtxStrip) ([]*rlwe.Ciphertext, error) {
+	if params.SensorHasMask {
+		return MaskedEuclideanIdentification(HE, query[0], query[1], queryWeights(params, query),
+			stripComponent(db, 0), stripComponent(db, 1), stripComponent(db, 2)), nil
+	}
+	switch params.Distance {
+	case DIST_WEIGHTED_EUCLIDEAN:
+		return WeightedEuclideanIdentification(HE, query[0], query[1], stripComponent(db, 0)), nil
+	case DIST_L1:
+		return L1Identification(HE, query[0], params.SensorD, stripComponent(db, 0))
+	}
+	return query[0].EuclideanIdentification(HE, stripComponent(db, 0)), nil
+}
+
+func (fingerModality) Verify(HE *HEHandler, params *JanusParams, query []*PlainStrip, strip []*CtxStrip, recIdx int) (*rlwe.Ciphertext, error) {
+	if params.SensorHasMask {
+		return MaskedEucVerify(HE, query[0], query[1], queryWeights(params, query),
+			strip[0], strip[1], strip[2], recIdx), nil
+	}
+	switch params.Distance {
+	case DIST_WEIGHTED_EUCLIDEAN:
+		return WeightedEucVerify(HE, query[0], query[1], strip[0], recIdx), nil
+	case DIST_L1:
+		return L1Verify(HE, query[0], params.SensorD, strip[0], recIdx)
+	}
+	return strip[0].EucVerify(HE, query[0], recIdx), nil
+}
+
+// Returns the weights strip of a masked query (nil for the unweighted distance)
+func queryWeights(params *JanusParams, query []*PlainStrip) *PlainStrip {
+	if params.Distance == DIST_WEIGHTED_EUCLIDEAN {
+		return query[2]
+	}
+	return nil
+}
+
+// iris: normalized Hamming distance between masked binary templates
+// The DB components are the mask, y.mask and ~y.mask of each record.
+type irisModality struct{}
+
+func (irisModality) Name() string                       { return "iris" }
+func (irisModality) HasMask() bool                      { return true }
+func (irisModality) SignedScore() bool                  { return true }
+func (irisModality) NumComponents(bio *JanusParams) int { return 3 }
+
+// Iris templates are masked binary codes
+func (irisModality) ValidateParams(bio *JanusParams) error {
+	if !bio.SensorHasMask {
+		return paramMismatch("iris templates require masks (SensorHasMask)")
+	}
+	if bio.SensorD != 2 {
+		return paramMismatch("iris templates are binary, got D = %v", bio.SensorD)
+	}
+	if bio.Distance != "" {
+		return paramMismatch("distance %v is only supported by finger", bio.Distance)
+	}
+	return nil
+}
+
+// 100*HD - MATCH_THRESHOLD*maskSize in [-MATCH_THRESHOLD*TS, (100-MATCH_THRESHOLD)*TS]
+func (irisModality) ScoreRange(bio JanusParams) (low, high int64) {
+	ts := int64(bio.TemplateSize)
+	return -int64(MATCH_THRESHOLD) * ts, (100 - int64(MATCH_THRESHOLD)) * ts
+}
+
+func (irisModality) NewRandom(rng *rand.Rand, bio *JanusParams) *PlainBio {
+	return newRandomIntBio(rng, bio)
+}
+
+func (irisModality) CreateFakeMatch(rng *rand.Rand, base *PlainBio, similarity float32) *PlainBio {
+	return createFakeIntMatch(rng, base, similarity)
+}
+
+// 100*HD - MATCH_THRESHOLD*maskSize, where HD is the masked Hamming distance
+func (irisModality) Score(params *JanusParams, query, target *PlainBio) int64 {
+	dist, maskSize := query.MaskedHammingDistance(target)
+	return IrisScore(dist, maskSize)
+}
+
+func (irisModality) PackDB(params *JanusParams, db []*PlainBio) ([][]*PlainStrip, error) {
+	records_y := make([][]int64, len(db))
+	records_mask := make([][]int64, len(db))
+	for i := 0; i < len(db); i++ {
+		records_y[i] = db[i].Data
+		records_mask[i] = db[i].Mask
+	}
+
+	yStrips, err := StripRecords(params, records_y)
+	if err != nil {
+		return nil, &PackingError{What: "DB y", Err: err}
+	}
+	maskStrips, err := StripRecords(params, records_mask)
+	if err != nil {
+		return nil, &PackingError{What: "DB mask", Err: err}
+	}
+
+	out := make([][]*PlainStrip, len(yStrips))
+	for i := range yStrips {
+		out[i] = []*PlainStrip{
+			maskStrips[i],
+			StripMul(maskStrips[i], yStrips[i]),
+			StripMul(maskStrips[i], yStrips[i].LogicNot()),
+		}
+	}
+	return out, nil
+}
+
+func (irisModality) PackQuery(params *JanusParams, query *PlainBio) ([]*PlainStrip, error) {
+	xStrip, err := ReplicateAsStripeRecords(params, query.Data)
+	if err != nil {
+		return nil, &PackingError{What: "Query data", Err: err}
+	}
+	maskStrip, err := ReplicateAsStripeRecords(params, query.Mask)
+	if err != nil {
+		return nil, &PackingError{What: "Query mask", Err: err}
+	}
+	return []*PlainStrip{xStrip, maskStrip}, nil
+}
+
+func (irisModality) Identification(HE *HEHandler, params *JanusParams, query []*PlainStrip, db [][]*CtxStrip) ([]*rlwe.Ciphertext, error) {
+	return NHammingDistance(HE, query[0], query[1], stripComponent(db, 1), stripComponent(db, 2), stripComponent(db, 0)), nil
+}
+
+func (irisModality) Verify(HE *HEHandler, params *JanusParams, query []*PlainStrip, strip []*CtxStrip, recIdx int) (*rlwe.Ciphertext, error) {
+	return NHammingVerify(HE, query[0], query[1], strip[1], strip[2], strip[0], recIdx), nil
+}
+
+// face: inner product of quantized normalized embeddings, see NewPlainFaceBio
+type faceModality struct{}
+
+func (faceModality) Name() string                       { return "face" }
+func (faceModality) HasMask() bool                      { return false }
+func (faceModality) SignedScore() bool                  { return true }
+func (faceModality) NumComponents(bio *JanusParams) int { return 1 }
+
+func (faceModality) ValidateParams(bio *JanusParams) error {
+	if bio.SensorHasMask {
+		return paramMismatch("face embeddings do not have masks (SensorHasMask)")
+	}
+	if bio.Distance != "" {
+		return paramMismatch("distance %v is only supported by finger", bio.Distance)
+	}
+	return nil
+}
+
+// FaceThreshold(D) - <x, y> in [FaceThreshold(D) - B^2, FaceThreshold(D) + B^2], where
+// B = (D-1) + sqrt(TS)/2 bounds the norm of a quantized unit embedding
+func (faceModality) ScoreRange(bio JanusParams) (low, high int64) {
+	norm := bio.SensorD - 1 + int64(math.Ceil(math.Sqrt(float64(bio.TemplateSize))/2))
+	threshold := FaceThreshold(bio.SensorD)
+	return threshold - norm*norm, threshold + norm*norm
+}
+
+func (faceModality) NewRandom(rng *rand.Rand, bio *JanusParams) *PlainBio {
+	return NewPlainFaceBio(NewRandomPlainFloatBio(rng, bio.TemplateSize), bio.SensorD)
+}
+
+// The embedding is perturbed to an expected cosine similarity of $similarity (in (0, 1])
+func (faceModality) CreateFakeMatch(rng *rand.Rand, base *PlainBio, similarity float32) *PlainBio {
+	// a gaussian noise of norm $noise gives a cosine similarity of 1/sqrt(1 + noise^2)
+	noise := math.Sqrt(1/float64(similarity*similarity) - 1)
+	return NewPlainFaceBio(base.FaceEmbedding().CreateFakeMatch(rng, noise), base.MaxVal)
+}
+
+// FaceThreshold(D) - <x, y>
+func (faceModality) Score(params *JanusParams, query, target *PlainBio) int64 {
+	prod := int64(0)
+	for i := range query.Data {
+		prod += query.Data[i] * target.Data[i]
+	}
+	return FaceThreshold(query.MaxVal) - prod
+}
+
+func (faceModality) PackDB(params *JanusParams, db []*PlainBio) ([][]*PlainStrip, error) {
+	return packDBData(params, db)
+}
+
+func (faceModality) PackQuery(params *JanusParams, query *PlainBio) ([]*PlainStrip, error) {
+	return packQueryData(params, query)
+}
+
+func (faceModality) Identification(HE *HEHandler, params *JanusParams, query []*PlainStrip, db [][]*CtxStrip) ([]*rlwe.Ciphertext, error) {
+	return FaceIdentification(HE, query[0], FaceThreshold(params.SensorD), stripComponent(db, 0)), nil
+}
+
+func (faceModality) Verify(HE *HEHandler, params *JanusParams, query []*PlainStrip, strip []*CtxStrip, recIdx int) (*rlwe.Ciphertext, error) {
+	return FaceVerify(HE, query[0], FaceThreshold(params.SensorD), strip[0], recIdx), nil
+}
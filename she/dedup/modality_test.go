@@ -0,0 +1,82 @@
+package dedup
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// Custom modality reusing the finger packing and distance, it counts its identifications
+type countingModality struct {
+	fingerModality
+	identifications int
+}
+
+func (*countingModality) Name() string { return "test-counting" }
+
+func (m *countingModality) Identification(HE *HEHandler, params *JanusParams, query []*PlainStrip, db [][]*CtxStrip) ([]*rlwe.Ciphertext, error) {
+	m.identifications++
+	return m.fingerModality.Identification(HE, params, query, db)
+}
+
+var testModality = &countingModality{}
+
+func init() {
+	RegisterModality(testModality)
+}
+
+func TestCustomModality(t *testing.T) {
+	found := false
+	for _, name := range ModalityNames() {
+		found = found || name == testModality.Name()
+	}
+	if !found {
+		t.Fatalf("%v not in the registered modalities %v", testModality.Name(), ModalityNames())
+	}
+
+	bio := testParams(testModality.Name())
+	bio.SensorD = 256
+	bpHE, janus := newTestJanus(t, bio)
+	query := setupTestDB(t, janus)
+	before := testModality.identifications
+	checkIdentification(t, bpHE, janus, query)
+	if testModality.identifications != before+1 {
+		t.Errorf("the identification did not use the registered modality")
+	}
+}
+
+func TestRegisterModalityTwicePanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("registering finger twice did not panic")
+		}
+	}()
+	RegisterModality(fingerModality{})
+}
+
+func TestUnsupportedModality(t *testing.T) {
+	if _, err := LookupModality("palm"); !errors.Is(err, ErrUnsupportedModality) {
+		t.Errorf("LookupModality(palm): got %v, want ErrUnsupportedModality", err)
+	}
+	bio := testParams("palm")
+	bio.Nbfv = 4096
+	params, err := SelectBFVParams(testParams("finger"), Classical128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewJanus(bio, &HEHandler{Params: params}); !errors.Is(err, ErrUnsupportedModality) {
+		t.Errorf("NewJanus(palm): got %v, want ErrUnsupportedModality", err)
+	}
+}
+
+func TestQueryPackingError(t *testing.T) {
+	_, janus := newTestJanus(t, testParams("finger"))
+	setupTestDB(t, janus)
+	// the query does not fit in CtxPerTemplate*SlotsPerCtx slots
+	query := &PlainBio{BioMode: "finger", Data: make([]int64, 65), MaxVal: 256}
+	_, err := janus.Identification(query)
+	if !errors.Is(err, ErrPacking) || !errors.Is(err, ErrParamMismatch) {
+		t.Errorf("Identification of a too large query: got %v, want ErrPacking and ErrParamMismatch", err)
+	}
+}
@@ -0,0 +1,227 @@
+package dedup
+
+import (
+	crand "crypto/rand"
+	"fmt"
+	"math"
+	"math/big"
+	"math/bits"
+
+	"github.com/tuneinsight/lattigo/v4/bfv"
+	"github.com/tuneinsight/lattigo/v4/dbfv"
+	"github.com/tuneinsight/lattigo/v4/drlwe"
+	"github.com/tuneinsight/lattigo/v4/ring"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+	"github.com/tuneinsight/lattigo/v4/utils"
+)
+
+// Statistical security (bits) of the smudging noise added by each party to its decryption share
+// The smudging noise is uniform in [-2^(B+λ), 2^(B+λ)] where 2^B bounds the noise of the
+// decrypted ciphertexts, so that the decryption reveals nothing about the noise (and the key
+// shares) except with probability 2^-λ per coefficient. The smudging of the lattigo CKS
+// protocol is divided by the special modulus P and cannot sample more than 64 bits.
+const SMUDGING_LAMBDA = 40
+
+// A key holder of the multiparty BP, it owns a share of the collective secret key
+type BPParty struct {
+	ID int
+	sk *rlwe.SecretKey
+}
+
+// The BP role split among several key holders (N-out-of-N threshold)
+// The collective secret key is the sum of the parties' shares and is never reconstructed:
+// all parties take part in the key generation and in the decryption of the distances.
+// The parties are simulated in-process, in a deployment each one runs on its own machine and
+// only the shares are exchanged.
+type MultipartyBP struct {
+	Params  bfv.Parameters
+	Parties []*BPParty
+
+	// Public handler with the collective public and evaluation keys, sent to the RS
+	HE *HEHandler
+	// Handler decrypting the outputs of CollectiveDecrypt
+	OutputHE *HEHandler
+
+	// log2 of the bound of the smudging noise of each decryption share
+	SmudgingBits int
+
+	crs utils.PRNG
+}
+
+// Bits consumed by the aggregated smudging noise of $nParties on top of the output noise
+func smudgingExtraBits(nParties int) float64 {
+	return SMUDGING_LAMBDA + math.Log2(float64(nParties)) + 1
+}
+
+// Selects the smallest BFV preset able to compute the identification of $bio and to decrypt
+// its outputs collectively among $nParties, see SelectBFVParams
+func SelectMultipartyBFVParams(bio *JanusParams, security SecurityLevel, nParties int) (bfv.Parameters, error) {
+	if nParties < 1 {
+		return bfv.Parameters{}, fmt.Errorf("SelectMultipartyBFVParams: invalid number of parties %v", nParties)
+	}
+	return selectBFVParams(bio, security, smudgingExtraBits(nParties))
+}
+
+// Runs the collective key generation among $nParties key holders
+// The keys include the rotation keys used by the identification of $bio. The common reference
+// string (CRS) is expanded from $crsSeed, which is public and shared by all parties.
+func NewMultipartyBP(params bfv.Parameters, bio *JanusParams, nParties int, crsSeed []byte) (*MultipartyBP, error) {
+	if nParties < 1 {
+		return nil, fmt.Errorf("NewMultipartyBP: invalid number of parties %v", nParties)
+	}
+	if err := bio.Validate(params); err != nil {
+		return nil, fmt.Errorf("NewMultipartyBP: %w", err)
+	}
+	logT := bits.Len64(params.T())
+	noise := bio.estimatedNoiseBits(params.LogN(), logT, bio.CtxPerTemplate)
+	if budget := noiseBudgetBits(params); noise+smudgingExtraBits(nParties)+NOISE_MARGIN_BITS >= budget {
+		return nil, fmt.Errorf("NewMultipartyBP: %w", paramMismatch("estimated noise of %.1f bits with the smudging noise of %v parties exceeds the noise budget of %.1f bits",
+			noise+smudgingExtraBits(nParties)+NOISE_MARGIN_BITS, nParties, budget))
+	}
+	crs, err := utils.NewKeyedPRNG(crsSeed)
+	if err != nil {
+		return nil, fmt.Errorf("NewMultipartyBP: %w", err)
+	}
+
+	mbp := &MultipartyBP{
+		Params:       params,
+		Parties:      make([]*BPParty, nParties),
+		SmudgingBits: int(math.Ceil(noise)) + SMUDGING_LAMBDA,
+		crs:          crs,
+	}
+	kgen := bfv.NewKeyGenerator(params)
+	for i := range mbp.Parties {
+		mbp.Parties[i] = &BPParty{ID: i, sk: kgen.GenSecretKey()}
+	}
+
+	pk := mbp.collectivePublicKey()
+	evk := rlwe.EvaluationKey{
+		Rlk:  mbp.collectiveRelinearizationKey(),
+		Rtks: mbp.collectiveRotationKeys(bio.GaloisElements(params)),
+	}
+	mbp.HE = &HEHandler{}
+	if err := mbp.HE.SetKeys(params, nil, pk, evk); err != nil {
+		return nil, fmt.Errorf("NewMultipartyBP: %w", err)
+	}
+
+	// After the collective key switch to the zero key, the first component holds the phase
+	mbp.OutputHE = &HEHandler{}
+	if err := mbp.OutputHE.SetKeys(params, rlwe.NewSecretKey(params.Parameters), pk, rlwe.EvaluationKey{}); err != nil {
+		return nil, fmt.Errorf("NewMultipartyBP: %w", err)
+	}
+	return mbp, nil
+}
+
+// Collective public key generation (CKG)
+func (mbp *MultipartyBP) collectivePublicKey() *rlwe.PublicKey {
+	ckg := dbfv.NewCKGProtocol(mbp.Params)
+	crp := ckg.SampleCRP(mbp.crs)
+
+	shares := make([]*drlwe.CKGShare, len(mbp.Parties))
+	for i, party := range mbp.Parties {
+		shares[i] = ckg.AllocateShare()
+		ckg.GenShare(party.sk, crp, shares[i])
+	}
+	for i := 1; i < len(shares); i++ {
+		ckg.AggregateShares(shares[0], shares[i], shares[0])
+	}
+
+	pk := rlwe.NewPublicKey(mbp.Params.Parameters)
+	ckg.GenPublicKey(shares[0], crp, pk)
+	return pk
+}
+
+// Two-round collective relinearization key generation (RKG)
+func (mbp *MultipartyBP) collectiveRelinearizationKey() *rlwe.RelinearizationKey {
+	rkg := dbfv.NewRKGProtocol(mbp.Params)
+	crp := rkg.SampleCRP(mbp.crs)
+
+	ephSks := make([]*rlwe.SecretKey, len(mbp.Parties))
+	round1 := make([]*drlwe.RKGShare, len(mbp.Parties))
+	round2 := make([]*drlwe.RKGShare, len(mbp.Parties))
+	for i := range mbp.Parties {
+		ephSks[i], round1[i], round2[i] = rkg.AllocateShare()
+	}
+
+	for i, party := range mbp.Parties {
+		rkg.GenShareRoundOne(party.sk, crp, ephSks[i], round1[i])
+	}
+	for i := 1; i < len(round1); i++ {
+		rkg.AggregateShares(round1[0], round1[i], round1[0])
+	}
+
+	for i, party := range mbp.Parties {
+		rkg.GenShareRoundTwo(ephSks[i], party.sk, round1[0], round2[i])
+	}
+	for i := 1; i < len(round2); i++ {
+		rkg.AggregateShares(round2[0], round2[i], round2[0])
+	}
+
+	rlk := rlwe.NewRelinearizationKey(mbp.Params.Parameters, 1)
+	rkg.GenRelinearizationKey(round1[0], round2[0], rlk)
+	return rlk
+}
+
+// Collective rotation key generation (RTG), one protocol instance per Galois element
+func (mbp *MultipartyBP) collectiveRotationKeys(galEls []uint64) *rlwe.RotationKeySet {
+	rtg := dbfv.NewRTGProtocol(mbp.Params)
+	rtks := rlwe.NewRotationKeySet(mbp.Params.Parameters, galEls)
+
+	for _, galEl := range galEls {
+		crp := rtg.SampleCRP(mbp.crs)
+		shares := make([]*drlwe.RTGShare, len(mbp.Parties))
+		for i, party := range mbp.Parties {
+			shares[i] = rtg.AllocateShare()
+			rtg.GenShare(party.sk, galEl, crp, shares[i])
+		}
+		for i := 1; i < len(shares); i++ {
+			rtg.AggregateShares(shares[0], shares[i], shares[0])
+		}
+		rtg.GenRotationKey(shares[0], crp, rtks.Keys[galEl])
+	}
+	return rtks
+}
+
+// Collective decryption of the distance ciphertexts (collective key switching, CKS)
+// Each party key switches its share of the secret key to the zero key, the aggregated shares
+// turn the ciphertexts into encryptions under the zero key that OutputHE decrypts.
+// The inputs are not modified.
+func (mbp *MultipartyBP) CollectiveDecrypt(ctxs []*rlwe.Ciphertext) []*rlwe.Ciphertext {
+	cks := dbfv.NewCKSProtocol(mbp.Params, mbp.Params.Sigma())
+	zero := mbp.OutputHE.SecretKey
+	bound := new(big.Int).Lsh(big.NewInt(1), uint(mbp.SmudgingBits))
+
+	out := make([]*rlwe.Ciphertext, len(ctxs))
+	for c, ctx := range ctxs {
+		shares := make([]*drlwe.CKSShare, len(mbp.Parties))
+		for i, party := range mbp.Parties {
+			shares[i] = cks.AllocateShare(ctx.Level())
+			cks.GenShare(party.sk, zero, ctx, shares[i])
+			mbp.smudge(shares[i].Value, bound)
+		}
+		for i := 1; i < len(shares); i++ {
+			cks.AggregateShares(shares[0], shares[i], shares[0])
+		}
+		out[c] = bfv.NewCiphertext(mbp.Params, 1, ctx.Level())
+		cks.KeySwitch(ctx, shares[0], out[c])
+	}
+	return out
+}
+
+// Adds a uniform noise in [-$bound, $bound] to the decryption share (coefficient domain)
+func (mbp *MultipartyBP) smudge(share *ring.Poly, bound *big.Int) {
+	ringQ := mbp.Params.RingQ().AtLevel(share.Level())
+	width := new(big.Int).Lsh(bound, 1)
+	width.Add(width, big.NewInt(1))
+	coeffs := make([]*big.Int, ringQ.N())
+	for i := range coeffs {
+		e, err := crand.Int(crand.Reader, width)
+		if err != nil {
+			panic(err)
+		}
+		coeffs[i] = e.Sub(e, bound)
+	}
+	noise := ringQ.NewPoly()
+	ringQ.SetCoefficientsBigint(coeffs, noise)
+	ringQ.Add(share, noise, share)
+}
@@ -0,0 +1,99 @@
+package dedup
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// Runs the key generation among $nParties and returns the Janus instance of the RS
+func newTestMultiparty(t *testing.T, bio *JanusParams, nParties int) (*MultipartyBP, *Janus) {
+	t.Helper()
+	params, err := SelectMultipartyBFVParams(bio, Classical128, nParties)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bio.Nbfv = params.N()
+	mbp, err := NewMultipartyBP(params, bio, nParties, make([]byte, SEED_SIZE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	janus, err := NewJanus(bio, mbp.HE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mbp, janus
+}
+
+// Handler holding the collective secret key, i.e., the sum of the shares of the parties
+func collectiveKeyHandler(t *testing.T, mbp *MultipartyBP) *HEHandler {
+	t.Helper()
+	sk := rlwe.NewSecretKey(mbp.Params.Parameters)
+	ringQP := mbp.Params.RingQP()
+	for _, party := range mbp.Parties {
+		ringQP.Add(sk.Value, party.sk.Value, sk.Value)
+	}
+	he := &HEHandler{}
+	if err := he.SetKeys(mbp.Params, sk, mbp.HE.PublicKey, rlwe.EvaluationKey{}); err != nil {
+		t.Fatal(err)
+	}
+	return he
+}
+
+func TestCollectiveDecryptMatchesSingleKey(t *testing.T) {
+	for _, bioType := range []string{"finger", "iris"} {
+		t.Run(bioType, func(t *testing.T) {
+			mbp, janus := newTestMultiparty(t, testParams(bioType), 3)
+			query := setupTestDB(t, janus)
+			encDist, err := janus.Identification(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want, err := BPprocessJanusIdReq(encDist, collectiveKeyHandler(t, mbp), janus.Params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decrypted := mbp.CollectiveDecrypt(encDist)
+			got, err := BPprocessJanusIdReq(decrypted, mbp.OutputHE, janus.Params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Fatalf("score %v: collective decryption %v, single-key decryption %v", i, got[i], want[i])
+				}
+			}
+			if err := CheckAnswer(got, janus.IdentificationGroundTruth(query), mbp.Params.T()); err != nil {
+				t.Fatal(err)
+			}
+
+			// the smudging noise floods the noise of the outputs
+			for _, ctx := range decrypted {
+				noise, err := mbp.OutputHE.NoiseBits(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if noise < float64(mbp.SmudgingBits-1) {
+					t.Errorf("noise of %.1f bits after the collective decryption, want at least %v bits of smudging", noise, mbp.SmudgingBits-1)
+				}
+			}
+		})
+	}
+}
+
+func TestNewMultipartyBPRejectsSmallBudget(t *testing.T) {
+	bio := testParams("finger")
+	params, err := SelectBFVParams(bio, Classical128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bio.Nbfv = params.N()
+	if _, err := NewMultipartyBP(params, bio, 3, make([]byte, SEED_SIZE)); !errors.Is(err, ErrParamMismatch) {
+		t.Errorf("NewMultipartyBP with the single BP parameters: got %v, want ErrParamMismatch", err)
+	}
+	if _, err := NewMultipartyBP(params, bio, 0, make([]byte, SEED_SIZE)); err == nil {
+		t.Errorf("NewMultipartyBP with 0 parties: got no error")
+	}
+}
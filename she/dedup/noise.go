@@ -0,0 +1,179 @@
+package dedup
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"math/rand"
+
+	"github.com/tuneinsight/lattigo/v4/bfv"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// Noise budget of the ciphertexts returned by the identification circuit
+type NoiseReport struct {
+	Budgets   []float64 // remaining noise budget (bits) of each output ciphertext
+	MinBudget float64
+}
+
+func (report *NoiseReport) Describe() string {
+	return fmt.Sprintf("Noise budget of %v output ciphertexts: min %.2f bits (%.2f ... %.2f)\n",
+		len(report.Budgets), report.MinBudget, report.Budgets[0], report.Budgets[len(report.Budgets)-1])
+}
+
+// Returns log2 of the largest noise coefficient of the ciphertext
+// Requires the secret key (decryptor) and the BFV backend.
+func (he *HEHandler) NoiseBits(ctx *rlwe.Ciphertext) (float64, error) {
+	encoder, ok := he.Encoder.(bfvEncoder)
+	if !ok {
+		return 0, fmt.Errorf("NoiseBits: %w, noise measurement not supported by the %v backend", ErrParamMismatch, he.Scheme)
+	}
+	if he.Decryptor == nil {
+		return 0, fmt.Errorf("NoiseBits: noise measurement requires the secret key")
+	}
+	level := ctx.Level()
+	ringQ := he.Params.RingQ().AtLevel(level)
+
+	// phase = Delta*m + e
+	phase := bfv.NewPlaintext(he.Params, level)
+	he.Decryptor.Decrypt(ctx, phase)
+
+	// Delta*m
+	ptRt := bfv.NewPlaintextRingT(he.Params)
+	encoder.ScaleDown(phase, ptRt)
+	scaled := bfv.NewPlaintext(he.Params, level)
+	encoder.ScaleUp(ptRt, scaled)
+
+	ringQ.Sub(phase.Value, scaled.Value, phase.Value)
+	coeffs := make([]*big.Int, he.Params.N())
+	for i := range coeffs {
+		coeffs[i] = new(big.Int)
+	}
+	ringQ.PolyToBigintCentered(phase.Value, 1, coeffs)
+
+	maxNoise := new(big.Int)
+	for _, c := range coeffs {
+		if c.CmpAbs(maxNoise) > 0 {
+			maxNoise.Abs(c)
+		}
+	}
+	if maxNoise.Sign() == 0 {
+		return 0, nil
+	}
+	noise, _ := new(big.Float).SetInt(maxNoise).Float64()
+	return math.Log2(noise), nil
+}
+
+// Returns the remaining noise budget (in bits) of the ciphertext
+// The decryption is correct as long as the noise is smaller than Q/(2T), i.e., budget > 0.
+func (he *HEHandler) NoiseBudget(ctx *rlwe.Ciphertext) (float64, error) {
+	noise, err := he.NoiseBits(ctx)
+	if err != nil {
+		return 0, err
+	}
+	Q, _ := new(big.Float).SetInt(he.Params.RingQ().AtLevel(ctx.Level()).Modulus()).Float64()
+	return math.Log2(Q) - math.Log2(float64(he.Params.T())) - 1 - noise, nil
+}
+
+func NoiseBudgetReport(he *HEHandler, ctxs []*rlwe.Ciphertext) (*NoiseReport, error) {
+	if len(ctxs) == 0 {
+		return nil, fmt.Errorf("NoiseBudgetReport: no ciphertexts")
+	}
+	report := &NoiseReport{
+		Budgets:   make([]float64, len(ctxs)),
+		MinBudget: math.Inf(1),
+	}
+	for i, ctx := range ctxs {
+		budget, err := he.NoiseBudget(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("NoiseBudgetReport: %w", err)
+		}
+		report.Budgets[i] = budget
+		report.MinBudget = math.Min(report.MinBudget, budget)
+	}
+	return report, nil
+}
+
+// The noise budget of some ciphertext is exhausted, its decryption is not correct
+// A noise larger than the budget wraps around: the measured noise saturates at a budget
+// of about 0 bits, at least one bit is required.
+func (report *NoiseReport) Exhausted() bool {
+	return report.MinBudget < 1
+}
+
+// Runs the identification circuit on a random database drawn from $rng with a fresh key
+// Returns the BP handler (with the secret key) and the output ciphertexts.
+func runIdentificationCircuit(rng *rand.Rand, bio *JanusParams, params bfv.Parameters) (*HEHandler, []*rlwe.Ciphertext, error) {
+	bpHE := &HEHandler{}
+	if err := bpHE.KeyGenForJanus(params, bio); err != nil {
+		return nil, nil, err
+	}
+	janus, err := NewJanus(bio, bpHE.GetPublicHandler())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	janus.GenerateUserDB(rng)
+	query := janus.GenerateMatchingQuery(rng, 0)
+	if err := janus.EncryptDatabase(); err != nil {
+		return nil, nil, err
+	}
+	encDist, err := janus.Identification(query)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bpHE, encDist, nil
+}
+
+// Runs the identification circuit on a random database with a fresh key and reports
+// the remaining noise budget of each output ciphertext.
+func EstimateNoiseBudget(rng *rand.Rand, bio *JanusParams, params bfv.Parameters) (*NoiseReport, error) {
+	bpHE, encDist, err := runIdentificationCircuit(rng, bio, params)
+	if err != nil {
+		return nil, fmt.Errorf("EstimateNoiseBudget: %w", err)
+	}
+	report, err := NoiseBudgetReport(bpHE, encDist)
+	if err != nil {
+		return nil, fmt.Errorf("EstimateNoiseBudget: %w", err)
+	}
+	return report, nil
+}
+
+// Returns the lowest level to which the identification outputs can be dropped before
+// the transfer while keeping at least $marginBits bits of noise budget.
+// The level is a public parameter: the BP estimates it once with its key and the RS
+// uses it to drop the outputs with DropLevel.
+func EstimateTransferLevel(rng *rand.Rand, bio *JanusParams, params bfv.Parameters, marginBits float64) (int, error) {
+	bpHE, encDist, err := runIdentificationCircuit(rng, bio, params)
+	if err != nil {
+		return 0, fmt.Errorf("EstimateTransferLevel: %w", err)
+	}
+	report, err := NoiseBudgetReport(bpHE, encDist)
+	if err != nil {
+		return 0, fmt.Errorf("EstimateTransferLevel: %w", err)
+	}
+	if report.MinBudget < marginBits {
+		return 0, fmt.Errorf("EstimateTransferLevel: %w, insufficient noise budget at the max level (%.2f bits, %v bits required)",
+			ErrParamMismatch, report.MinBudget, marginBits)
+	}
+
+	best := params.MaxLevel()
+	for level := params.MaxLevel() - 1; level >= 0; level-- {
+		dropped := make([]*rlwe.Ciphertext, len(encDist))
+		for i := range encDist {
+			dropped[i] = encDist[i].CopyNew()
+		}
+		if err := DropLevel(bpHE, dropped, level); err != nil {
+			return 0, fmt.Errorf("EstimateTransferLevel: %w", err)
+		}
+		report, err := NoiseBudgetReport(bpHE, dropped)
+		if err != nil {
+			return 0, fmt.Errorf("EstimateTransferLevel: %w", err)
+		}
+		if report.MinBudget < marginBits {
+			break
+		}
+		best = level
+	}
+	return best, nil
+}
@@ -0,0 +1,65 @@
+package dedup
+
+import (
+	"errors"
+	"math/bits"
+	"math/rand"
+	"testing"
+)
+
+func TestNoiseEstimateBoundsMeasuredNoise(t *testing.T) {
+	for _, bioType := range []string{"finger", "iris", "face"} {
+		for _, pack := range []bool{false, true} {
+			bio := testParams(bioType)
+			bio.PackResults = pack
+			params, err := SelectBFVParams(bio, PostQuantum128)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bio.Nbfv = params.N()
+			bpHE, encDist, err := runIdentificationCircuit(rand.New(rand.NewSource(1)), bio, params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			estimate := bio.estimatedNoiseBits(params.LogN(), bits.Len64(params.T()), bio.CtxPerTemplate)
+			for i, ctx := range encDist {
+				measured, err := bpHE.NoiseBits(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if measured > estimate {
+					t.Errorf("%v (PackResults %v) output %v: measured noise %.2f bits > estimate %.2f bits",
+						bioType, pack, i, measured, estimate)
+				}
+			}
+
+			report, err := EstimateNoiseBudget(rand.New(rand.NewSource(1)), bio, params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Exhausted() || report.MinBudget < NOISE_MARGIN_BITS {
+				t.Errorf("%v (PackResults %v): remaining budget %.2f bits with the selected parameters", bioType, pack, report.MinBudget)
+			}
+		}
+	}
+}
+
+func TestNoiseBitsRequiresBFV(t *testing.T) {
+	bio := testParams("finger")
+	params, err := SelectBFVParams(bio, PostQuantum128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bio.Nbfv = params.N()
+	bpHE := &HEHandler{Scheme: SCHEME_BGV}
+	if err := bpHE.KeyGenForJanus(params, bio); err != nil {
+		t.Fatal(err)
+	}
+	ctx := bpHE.Encryptor.EncryptNew(bpHE.Encoder.EncodeNew([]uint64{1}, params.MaxLevel()))
+	if _, err := bpHE.NoiseBits(ctx); !errors.Is(err, ErrParamMismatch) {
+		t.Errorf("NoiseBits with %v: got %v, want ErrParamMismatch", SCHEME_BGV, err)
+	}
+	if _, err := bpHE.GetPublicHandler().NoiseBits(ctx); err == nil {
+		t.Errorf("NoiseBits without the secret key: got no error")
+	}
+}
@@ -0,0 +1,84 @@
+package dedup
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// Scores of real-valued embeddings (CKKS path)
+const (
+	FLOAT_METRIC_COSINE    = "cosine"    // cosine similarity, larger is closer
+	FLOAT_METRIC_EUCLIDEAN = "euclidean" // squared Euclidean distance, smaller is closer
+)
+
+// Real-valued feature embedding (e.g., the output of a face or finger network)
+// Embeddings are L2-normalized: the cosine similarity is the inner product and lies in [-1, 1],
+// the squared Euclidean distance is 2 - 2*cosine and lies in [0, 4].
+type PlainFloatBio struct {
+	Data []float64
+}
+
+// Returns a random unit embedding of dimension $dim drawn from $rng
+func NewRandomPlainFloatBio(rng *rand.Rand, dim int) *PlainFloatBio {
+	bio := &PlainFloatBio{Data: make([]float64, dim)}
+	for i := range bio.Data {
+		bio.Data[i] = rng.NormFloat64()
+	}
+	bio.Normalize()
+	return bio
+}
+
+// Scales the embedding to unit L2 norm
+func (base *PlainFloatBio) Normalize() {
+	norm := math.Sqrt(innerProduct(base.Data, base.Data))
+	if norm == 0 {
+		return
+	}
+	for i := range base.Data {
+		base.Data[i] /= norm
+	}
+}
+
+// Returns a unit embedding close to $base: each coordinate is perturbed by a gaussian noise
+// of standard deviation $noise/sqrt(dim)
+func (base *PlainFloatBio) CreateFakeMatch(rng *rand.Rand, noise float64) *PlainFloatBio {
+	bio := &PlainFloatBio{Data: make([]float64, len(base.Data))}
+	sigma := noise / math.Sqrt(float64(len(base.Data)))
+	for i := range bio.Data {
+		bio.Data[i] = base.Data[i] + sigma*rng.NormFloat64()
+	}
+	bio.Normalize()
+	return bio
+}
+
+func (base *PlainFloatBio) CosineSimilarity(target *PlainFloatBio) float64 {
+	return innerProduct(base.Data, target.Data) /
+		math.Sqrt(innerProduct(base.Data, base.Data)*innerProduct(target.Data, target.Data))
+}
+
+func (base *PlainFloatBio) SquaredEuclidean(target *PlainFloatBio) float64 {
+	dist := 0.0
+	for i := range base.Data {
+		dist += (base.Data[i] - target.Data[i]) * (base.Data[i] - target.Data[i])
+	}
+	return dist
+}
+
+// Plaintext reference of the encrypted score with $metric
+func (base *PlainFloatBio) ComputeFloatScore(target *PlainFloatBio, metric string) (float64, error) {
+	if metric == FLOAT_METRIC_COSINE {
+		return base.CosineSimilarity(target), nil
+	} else if metric == FLOAT_METRIC_EUCLIDEAN {
+		return base.SquaredEuclidean(target), nil
+	}
+	return 0, fmt.Errorf("metric %v: %w", metric, ErrUnsupportedModality)
+}
+
+func innerProduct(x, y []float64) float64 {
+	out := 0.0
+	for i := range x {
+		out += x[i] * y[i]
+	}
+	return out
+}
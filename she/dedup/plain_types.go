@@ -1,33 +1,47 @@
 package dedup
 
 import (
+	"math"
 	"math/rand"
 )
 
 const MATCH_THRESHOLD uint64 = 40
 
+// Cosine similarity threshold (in percent) of the face modality
+const FACE_MATCH_THRESHOLD uint64 = 50
+
 type PlainBio struct {
-	BioMode string  // finger, iris
+	BioMode string  // finger, iris, face
 	Data    []int64 // data may be 1 byte, compatibility with lattigo
 	Mask    []int64 // Mask is binary
 	MaxVal  int64
 	HasMask bool
 }
 
-func NewRandomPlainBio(bio *JanusParams) *PlainBio {
+// Returns a random template of the modality of $bio drawn from $rng
+func NewRandomPlainBio(rng *rand.Rand, bio *JanusParams) *PlainBio {
+	if m, err := LookupModality(bio.BioType); err == nil {
+		return m.NewRandom(rng, bio)
+	}
+	return newRandomIntBio(rng, bio)
+}
+
+// Random template of TS values in [0, D) and a random mask if the sensor has a mask
+func newRandomIntBio(rng *rand.Rand, bio *JanusParams) *PlainBio {
 	fc := &PlainBio{
+		BioMode: bio.BioType,
 		Data:    make([]int64, bio.TemplateSize),
 		MaxVal:  bio.SensorD,
 		HasMask: bio.SensorHasMask,
 	}
 	for i := 0; i < bio.TemplateSize; i++ {
-		fc.Data[i] = rand.Int63n(bio.SensorD)
+		fc.Data[i] = rng.Int63n(bio.SensorD)
 	}
 
 	if bio.SensorHasMask {
 		fc.Mask = make([]int64, bio.TemplateSize)
 		for i := 0; i < bio.TemplateSize; i++ {
-			if rand.Float32() < 0.85 {
+			if rng.Float32() < 0.85 {
 				fc.Mask[i] = 1
 			}
 		}
@@ -35,9 +49,19 @@ func NewRandomPlainBio(bio *JanusParams) *PlainBio {
 	return fc
 }
 
-func (base *PlainBio) CreateFakeMatch(similarity float32) *PlainBio {
+// Returns a template close to $base, see the CreateFakeMatch of the modality
+func (base *PlainBio) CreateFakeMatch(rng *rand.Rand, similarity float32) *PlainBio {
+	if m, err := LookupModality(base.BioMode); err == nil {
+		return m.CreateFakeMatch(rng, base, similarity)
+	}
+	return createFakeIntMatch(rng, base, similarity)
+}
+
+// Each value of $base is kept with probability $similarity, the mask is resampled
+func createFakeIntMatch(rng *rand.Rand, base *PlainBio, similarity float32) *PlainBio {
 	dlen := len(base.Data)
 	bio := &PlainBio{
+		BioMode: base.BioMode,
 		Data:    make([]int64, dlen),
 		MaxVal:  base.MaxVal,
 		HasMask: base.HasMask,
@@ -45,7 +69,7 @@ func (base *PlainBio) CreateFakeMatch(similarity float32) *PlainBio {
 
 	for i := 0; i < dlen; i++ {
 		bio.Data[i] = base.Data[i]
-		if rand.Float32() > similarity {
+		if rng.Float32() > similarity {
 			bio.Data[i] = (1 - bio.Data[i] + bio.MaxVal) % bio.MaxVal
 		}
 	}
@@ -53,7 +77,7 @@ func (base *PlainBio) CreateFakeMatch(similarity float32) *PlainBio {
 	if bio.HasMask {
 		bio.Mask = make([]int64, dlen)
 		for i := 0; i < dlen; i++ {
-			if rand.Float32() < 0.85 {
+			if rng.Float32() < 0.85 {
 				bio.Mask[i] = 1
 			}
 		}
@@ -61,6 +85,8 @@ func (base *PlainBio) CreateFakeMatch(similarity float32) *PlainBio {
 	return bio
 }
 
+// Euclidean distance on the intersection of the masks
+// This is the finger score, use JanusParams.ComputeScore for the score of any modality.
 func (base *PlainBio) ComputeDist(target *PlainBio) (dist int64) {
 	if base.HasMask && target.HasMask {
 		mask := MergeMask(base.Mask, target.Mask)
@@ -73,6 +99,74 @@ func (base *PlainBio) ComputeDist(target *PlainBio) (dist int64) {
 	}
 }
 
+// Returns the Hamming distance of the templates on the intersection of their masks, and
+// the size of the intersection
+// The normalized Hamming distance is dist/maskSize.
+func (base *PlainBio) MaskedHammingDistance(target *PlainBio) (dist, maskSize int64) {
+	for i := range base.Data {
+		m := base.Mask[i] * target.Mask[i]
+		maskSize += m
+		if base.Data[i] != target.Data[i] {
+			dist += m
+		}
+	}
+	return dist, maskSize
+}
+
+// Signed iris score computed by the encrypted identification: 100*dist - MATCH_THRESHOLD*maskSize
+// The score is negative iff the normalized Hamming distance is below MATCH_THRESHOLD percent.
+func IrisScore(dist, maskSize int64) int64 {
+	return 100*dist - int64(MATCH_THRESHOLD)*maskSize
+}
+
 func (base *PlainBio) Match(target *PlainBio, threshold int64) bool {
 	return base.ComputeDist(target) <= threshold
 }
+
+// Computes the score of the encrypted identification in plaintext, see the Score of the modality
+func (bio *JanusParams) ComputeScore(query, target *PlainBio) int64 {
+	if m, err := LookupModality(bio.BioType); err == nil {
+		return m.Score(bio, query, target)
+	}
+	return query.ComputeDist(target)
+}
+
+// Returns random per-feature weights in [1, maxWeight] (see DIST_WEIGHTED_EUCLIDEAN)
+func NewRandomFeatureWeights(rng *rand.Rand, ts int, maxWeight int64) []int64 {
+	weights := make([]int64, ts)
+	for i := range weights {
+		weights[i] = 1 + rng.Int63n(maxWeight)
+	}
+	return weights
+}
+
+// Quantizes a normalized face embedding to fixed point: each value is rounded to
+// an integer in [-(maxVal-1), maxVal-1] (e.g., maxVal = 128 for int8 embeddings).
+// The inner product of two quantized embeddings is about (maxVal-1)^2 times their cosine similarity.
+func NewPlainFaceBio(emb *PlainFloatBio, maxVal int64) *PlainBio {
+	bio := &PlainBio{
+		BioMode: "face",
+		Data:    make([]int64, len(emb.Data)),
+		MaxVal:  maxVal,
+	}
+	for i, v := range emb.Data {
+		bio.Data[i] = int64(math.Round(v * float64(maxVal-1)))
+	}
+	return bio
+}
+
+// Returns the real-valued embedding of a quantized face template
+func (base *PlainBio) FaceEmbedding() *PlainFloatBio {
+	emb := &PlainFloatBio{Data: make([]float64, len(base.Data))}
+	for i, v := range base.Data {
+		emb.Data[i] = float64(v) / float64(base.MaxVal-1)
+	}
+	return emb
+}
+
+// Inner product threshold of the face modality: FACE_MATCH_THRESHOLD percent of the
+// inner product of a quantized embedding with itself
+// The face score FaceThreshold - <x, y> is negative for a match.
+func FaceThreshold(maxVal int64) int64 {
+	return int64(FACE_MATCH_THRESHOLD) * (maxVal - 1) * (maxVal - 1) / 100
+}
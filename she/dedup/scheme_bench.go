@@ -0,0 +1,86 @@
+package dedup
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/tuneinsight/lattigo/v4/bfv"
+)
+
+// Latency and sizes of the identification run with one SHE scheme
+type SchemeBenchmark struct {
+	Scheme string
+
+	KeyGen         time.Duration
+	EncryptDB      time.Duration
+	Identification time.Duration // RS cost
+	Decryption     time.Duration // BP cost
+
+	CtxBytes      int // size of a fresh ciphertext
+	DBBytes       int // size of the encrypted DB
+	TransferBytes int // size of the identification outputs
+
+	Correct bool // the decrypted scores match the plaintext ground truth
+}
+
+func (bench *SchemeBenchmark) Describe() string {
+	return fmt.Sprintf("%v: keygen %v, encrypt DB %v, RS %v, BP %v | ctx %v B, DB %v B, transfer %v B | correct %v\n",
+		bench.Scheme, bench.KeyGen, bench.EncryptDB, bench.Identification, bench.Decryption,
+		bench.CtxBytes, bench.DBBytes, bench.TransferBytes, bench.Correct)
+}
+
+// Runs the identification of $bio on a random database drawn from $rng with $scheme and
+// measures its latency and ciphertext sizes. The same parameters are used for all schemes.
+func BenchmarkScheme(rng *rand.Rand, bio *JanusParams, params bfv.Parameters, scheme string) (*SchemeBenchmark, error) {
+	bench := &SchemeBenchmark{Scheme: scheme}
+
+	start := time.Now()
+	bpHE := &HEHandler{Scheme: scheme}
+	if err := bpHE.KeyGenForJanus(params, bio); err != nil {
+		return nil, fmt.Errorf("BenchmarkScheme: %w", err)
+	}
+	janus, err := NewJanus(bio, bpHE.GetPublicHandler())
+	if err != nil {
+		return nil, fmt.Errorf("BenchmarkScheme: %w", err)
+	}
+	bench.KeyGen = time.Since(start)
+
+	janus.GenerateUserDB(rng)
+	query := janus.GenerateMatchingQuery(rng, 0)
+	start = time.Now()
+	if err := janus.EncryptDatabase(); err != nil {
+		return nil, fmt.Errorf("BenchmarkScheme: %w", err)
+	}
+	bench.EncryptDB = time.Since(start)
+	for _, strip := range janus.encDB.orderedStrips() {
+		for _, ctx := range strip.Strips {
+			bench.DBBytes += ctx.MarshalBinarySize()
+		}
+	}
+	bench.CtxBytes = janus.encDB.orderedStrips()[0].Strips[0].MarshalBinarySize()
+
+	start = time.Now()
+	encDist, err := janus.Identification(query)
+	if err != nil {
+		return nil, fmt.Errorf("BenchmarkScheme: %w", err)
+	}
+	bench.Identification = time.Since(start)
+	for _, ctx := range encDist {
+		bench.TransferBytes += ctx.MarshalBinarySize()
+	}
+
+	start = time.Now()
+	answer, err := BPprocessJanusIdReq(encDist, bpHE, bio)
+	if err != nil {
+		return nil, fmt.Errorf("BenchmarkScheme: %w", err)
+	}
+	bench.Decryption = time.Since(start)
+
+	groundTruth := make([]int64, bio.DbSize)
+	for i := range groundTruth {
+		groundTruth[i] = janus.Params.ComputeScore(query, janus.db[i])
+	}
+	bench.Correct = CheckAnswer(answer, groundTruth, params.T()) == nil
+	return bench, nil
+}
@@ -0,0 +1,417 @@
+package dedup
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/tuneinsight/lattigo/v4/bfv"
+	"github.com/tuneinsight/lattigo/v4/ring"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+	"github.com/tuneinsight/lattigo/v4/rlwe/ringqp"
+	"github.com/tuneinsight/lattigo/v4/utils"
+)
+
+// Seeded (compressed) serialization
+// A fresh symmetric RLWE encryption is (c0, c1) = (-a.s + e + m, a) where a is uniform.
+// If a is sampled from a keyed PRNG, it can be replaced by the PRNG seed in the
+// serialization, which halves the size of the ciphertexts and evaluation keys.
+// All ciphertexts (resp. keys) of an array share the same PRNG stream, they must be
+// deserialized in the same order they were generated.
+
+const SEED_SIZE = 32
+
+func NewSeed() ([]byte, error) {
+	prng, err := utils.NewPRNG()
+	if err != nil {
+		return nil, err
+	}
+	seed := make([]byte, SEED_SIZE)
+	prng.Read(seed)
+	return seed, nil
+}
+
+// Symmetric encryptor whose uniform components are sampled from a keyed PRNG
+type SeededEncryptor struct {
+	Seed []byte
+
+	params    bfv.Parameters
+	encoder   bfv.Encoder
+	encryptor rlwe.Encryptor
+}
+
+func NewSeededEncryptor(params bfv.Parameters, sk *rlwe.SecretKey, seed []byte) (*SeededEncryptor, error) {
+	prng, err := utils.NewKeyedPRNG(seed)
+	if err != nil {
+		return nil, err
+	}
+	return &SeededEncryptor{
+		Seed:      seed,
+		params:    params,
+		encoder:   bfv.NewEncoder(params),
+		encryptor: bfv.NewPRNGEncryptor(params, sk).WithPRNG(prng),
+	}, nil
+}
+
+func (enc *SeededEncryptor) EncryptNew(pt *rlwe.Plaintext) *rlwe.Ciphertext {
+	return enc.encryptor.EncryptNew(pt)
+}
+
+func (enc *SeededEncryptor) EncryptStrip(base *PlainStrip) *CtxStrip {
+	out := &CtxStrip{
+		CtxPerTemplate: base.CtxPerTemplate,
+		SlotPerCtx:     base.SlotPerCtx,
+		RecPerCtx:      base.RecPerCtx,
+		Strips:         make([]*rlwe.Ciphertext, base.CtxPerTemplate),
+	}
+	for i := 0; i < base.CtxPerTemplate; i++ {
+		out.Strips[i] = enc.EncryptNew(enc.encoder.EncodeNew(base.Strips[i], enc.params.MaxLevel()))
+	}
+	return out
+}
+
+// Marshals ciphertexts encrypted by a SeededEncryptor with $seed
+// The first element is the seed, the following ones only hold c0.
+func MarshalSeededCtxArray(seed []byte, ctxs []*rlwe.Ciphertext) ([][]byte, error) {
+	marshalledCiphers := make([][]byte, 0, len(ctxs)+1)
+	marshalledCiphers = append(marshalledCiphers, seed)
+	for _, ctx := range ctxs {
+		if ctx.Degree() != 1 {
+			return nil, fmt.Errorf("MarshalSeededCtxArray: ciphertext of degree %v is not fresh", ctx.Degree())
+		}
+		data, err := ctx.Value[0].MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		marshalledCiphers = append(marshalledCiphers, data)
+	}
+	return marshalledCiphers, nil
+}
+
+// Regenerates the uniform components from the seed
+func UnMarshalSeededCtxArray(params bfv.Parameters, data [][]byte) ([]*rlwe.Ciphertext, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("UnMarshalSeededCtxArray: missing seed")
+	}
+	prng, err := utils.NewKeyedPRNG(data[0])
+	if err != nil {
+		return nil, err
+	}
+	sampler := ringqp.NewUniformSampler(prng, *params.RingQP())
+
+	ctxs := make([]*rlwe.Ciphertext, len(data)-1)
+	for i := range ctxs {
+		// the header holds the degree and level of c0
+		if len(data[i+1]) < 5 || int(data[i+1][4]) > params.MaxLevel() || !checkPolyHeader(data[i+1], params.N(), int(data[i+1][4])) {
+			return nil, fmt.Errorf("UnMarshalSeededCtxArray: invalid encoding of ciphertext %v", i)
+		}
+		c0 := new(ring.Poly)
+		if err := c0.UnmarshalBinary(data[i+1]); err != nil {
+			return nil, err
+		}
+		level := c0.Level()
+		ctxs[i] = bfv.NewCiphertext(params, 1, level)
+		ctxs[i].Value[0] = c0
+
+		// same sampling as the symmetric encryption: c1 is sampled in the NTT domain
+		c1 := ctxs[i].Value[1]
+		sampler.AtLevel(level, -1).Read(ringqp.Poly{Q: c1})
+		params.RingQ().AtLevel(level).INTT(c1, c1)
+	}
+	return ctxs, nil
+}
+
+// Returns the encrypted DB strips in the order they are encrypted
+func (db *EncryptedDB) orderedStrips() []*CtxStrip {
+	out := make([]*CtxStrip, 0)
+	for i := range db.strips {
+		out = append(out, db.strips[i]...)
+	}
+	return out
+}
+
+// Serializes a DB encrypted by EncryptDatabaseSeeded
+func (janus *Janus) MarshalSeededDatabase() ([][]byte, error) {
+	if janus.encDB == nil || janus.encDB.seed == nil {
+		return nil, fmt.Errorf("MarshalSeededDatabase: the DB is not encrypted with a seeded encryptor")
+	}
+	ctxs := make([]*rlwe.Ciphertext, 0)
+	for _, strip := range janus.encDB.orderedStrips() {
+		ctxs = append(ctxs, strip.Strips...)
+	}
+	return MarshalSeededCtxArray(janus.encDB.seed, ctxs)
+}
+
+// Loads a DB serialized by MarshalSeededDatabase (e.g., uploaded by an enrollment device)
+func (janus *Janus) LoadSeededDatabase(data [][]byte) error {
+	ctxs, err := UnMarshalSeededCtxArray(janus.HE.Params, data)
+	if err != nil {
+		return err
+	}
+	db, err := janus.groupStrips(ctxs)
+	if err != nil {
+		return fmt.Errorf("LoadSeededDatabase: %w", err)
+	}
+	db.seed = data[0]
+	janus.encDB = db
+	return nil
+}
+
+// Groups the ciphertexts of the ordered strips of a serialized DB by strip and component
+// The DB is encrypted under the current key epoch of the RS.
+func (janus *Janus) groupStrips(ctxs []*rlwe.Ciphertext) (*EncryptedDB, error) {
+	ctxPerTemplate := janus.Params.CtxPerTemplate
+	if len(ctxs)%ctxPerTemplate != 0 {
+		return nil, fmt.Errorf("%w, %v ciphertexts is not a multiple of CtxPerTemplate(%v)", ErrParamMismatch, len(ctxs), ctxPerTemplate)
+	}
+	strips := make([]*CtxStrip, len(ctxs)/ctxPerTemplate)
+	for i := range strips {
+		strips[i] = &CtxStrip{
+			CtxPerTemplate: ctxPerTemplate,
+			SlotPerCtx:     janus.Params.SlotsPerCtx,
+			RecPerCtx:      janus.Params.Nbfv / janus.Params.SlotsPerCtx,
+			Strips:         ctxs[i*ctxPerTemplate : (i+1)*ctxPerTemplate],
+		}
+	}
+
+	m, err := LookupModality(janus.Params.BioType)
+	if err != nil {
+		return nil, err
+	}
+	components := m.NumComponents(janus.Params)
+	if len(strips)%components != 0 {
+		return nil, fmt.Errorf("%w, %v DB requires %v strips per batch, got %v", ErrParamMismatch, m.Name(), components, len(strips))
+	}
+	db := &EncryptedDB{bioType: m.Name(), keyEpoch: janus.HE.Epoch}
+	for i := 0; i < len(strips); i += components {
+		db.strips = append(db.strips, strips[i:i+components])
+	}
+	if len(db.strips) != janus.Params.NumStrips() {
+		return nil, fmt.Errorf("%w, %v strips for DB[%v], expected %v", ErrParamMismatch, len(db.strips), janus.Params.DbSize, janus.Params.NumStrips())
+	}
+	return db, nil
+}
+
+// Evaluation key generated by GenSeededEvaluationKey and its seed
+type SeededEvaluationKey struct {
+	Seed           []byte
+	GaloisElements []uint64
+	rlwe.EvaluationKey
+}
+
+// Generates the evaluation keys with uniform components sampled from a keyed PRNG
+// Rotation keys are generated in increasing order of the Galois elements.
+func GenSeededEvaluationKey(params bfv.Parameters, sk *rlwe.SecretKey, seed []byte, galEls []uint64) (*SeededEvaluationKey, error) {
+	if len(seed) != SEED_SIZE {
+		return nil, fmt.Errorf("GenSeededEvaluationKey: seed must be %v bytes", SEED_SIZE)
+	}
+	prng, err := utils.NewKeyedPRNG(seed)
+	if err != nil {
+		return nil, err
+	}
+	enc := bfv.NewPRNGEncryptor(params, sk).WithPRNG(prng)
+	ringQ, ringP := params.RingQ(), params.RingP()
+	levelQ, levelP := params.MaxLevelQ(), params.MaxLevelP()
+	buff := ringQ.NewPoly()
+
+	genSwitchingKey := func(skIn *ring.Poly, skOut *rlwe.SecretKey) *rlwe.SwitchingKey {
+		swk := rlwe.NewSwitchingKey(params.Parameters, levelQ, levelP)
+		encOut := enc.WithKey(skOut)
+		for i := range swk.Value {
+			for j := range swk.Value[i] {
+				encOut.EncryptZero(&swk.Value[i][j])
+			}
+		}
+		rlwe.AddPolyTimesGadgetVectorToGadgetCiphertext(skIn, []rlwe.GadgetCiphertext{swk.GadgetCiphertext}, *params.RingQP(), params.Pow2Base(), buff)
+		return swk
+	}
+
+	// relinearization key (degree 2): s^2 -> s
+	sk2 := ringQ.NewPoly()
+	ringQ.MulCoeffsMontgomery(sk.Value.Q, sk.Value.Q, sk2)
+	rlk := &rlwe.RelinearizationKey{Keys: []*rlwe.SwitchingKey{genSwitchingKey(sk2, sk)}}
+
+	galEls = sortedGaloisElements(galEls)
+	rtks := &rlwe.RotationKeySet{Keys: make(map[uint64]*rlwe.SwitchingKey, len(galEls))}
+	for _, galEl := range galEls {
+		index := ringQ.PermuteNTTIndex(params.InverseGaloisElement(galEl))
+		skOut := rlwe.NewSecretKey(params.Parameters)
+		ringQ.PermuteNTTWithIndex(sk.Value.Q, index, skOut.Value.Q)
+		if ringP != nil {
+			ringP.PermuteNTTWithIndex(sk.Value.P, index, skOut.Value.P)
+		}
+		rtks.Keys[galEl] = genSwitchingKey(sk.Value.Q, skOut)
+	}
+
+	return &SeededEvaluationKey{
+		Seed:           seed,
+		GaloisElements: galEls,
+		EvaluationKey:  rlwe.EvaluationKey{Rlk: rlk, Rtks: rtks},
+	}, nil
+}
+
+func sortedGaloisElements(galEls []uint64) []uint64 {
+	out := append([]uint64{}, galEls...)
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+func (evk *SeededEvaluationKey) switchingKeys() []*rlwe.SwitchingKey {
+	swks := append([]*rlwe.SwitchingKey{}, evk.Rlk.Keys...)
+	for _, galEl := range evk.GaloisElements {
+		swks = append(swks, evk.Rtks.Keys[galEl])
+	}
+	return swks
+}
+
+// Marshals the evaluation key, only the non-uniform component of each gadget ciphertext is stored
+// Format: seed | #galEls | galEls | relin degree | b components
+func (evk *SeededEvaluationKey) MarshalBinary() ([]byte, error) {
+	if len(evk.Seed) != SEED_SIZE {
+		return nil, fmt.Errorf("SeededEvaluationKey: seed must be %v bytes", SEED_SIZE)
+	}
+	galEls := evk.GaloisElements
+
+	data := make([]byte, 0)
+	data = append(data, evk.Seed...)
+	data = appendUint64(data, uint64(len(galEls)))
+	for _, galEl := range galEls {
+		data = appendUint64(data, galEl)
+	}
+	data = appendUint64(data, uint64(len(evk.Rlk.Keys)))
+
+	for _, swk := range evk.switchingKeys() {
+		for i := range swk.Value {
+			for j := range swk.Value[i] {
+				b := swk.Value[i][j].Value[0]
+				buff := make([]byte, b.MarshalBinarySize64())
+				if _, err := b.Encode64(buff); err != nil {
+					return nil, err
+				}
+				data = append(data, buff...)
+			}
+		}
+	}
+	return data, nil
+}
+
+// Unmarshals a seeded evaluation key and regenerates the uniform components from the seed
+func UnMarshalSeededEvaluationKey(params bfv.Parameters, data []byte) (*SeededEvaluationKey, error) {
+	if len(data) < SEED_SIZE {
+		return nil, fmt.Errorf("UnMarshalSeededEvaluationKey: data too short")
+	}
+	evk := &SeededEvaluationKey{Seed: append([]byte{}, data[:SEED_SIZE]...)}
+	ptr := SEED_SIZE
+
+	nGalEls, ptr, err := readUint64(data, ptr)
+	if err != nil {
+		return nil, fmt.Errorf("UnMarshalSeededEvaluationKey: %w", err)
+	}
+	if nGalEls > uint64(len(data)-ptr)/8 {
+		return nil, fmt.Errorf("UnMarshalSeededEvaluationKey: data too short for %v Galois elements", nGalEls)
+	}
+	evk.GaloisElements = make([]uint64, nGalEls)
+	for i := range evk.GaloisElements {
+		evk.GaloisElements[i], ptr, _ = readUint64(data, ptr)
+		if i > 0 && evk.GaloisElements[i] <= evk.GaloisElements[i-1] {
+			return nil, fmt.Errorf("UnMarshalSeededEvaluationKey: Galois elements are not sorted")
+		}
+	}
+	nRlk, ptr, err := readUint64(data, ptr)
+	if err != nil {
+		return nil, fmt.Errorf("UnMarshalSeededEvaluationKey: %w", err)
+	}
+
+	// all switching keys have the same size, check it before the allocation
+	levelQ, levelP := params.MaxLevelQ(), params.MaxLevelP()
+	swk := rlwe.NewSwitchingKey(params.Parameters, levelQ, levelP)
+	swkSize := 0
+	for i := range swk.Value {
+		for j := range swk.Value[i] {
+			swkSize += swk.Value[i][j].Value[0].MarshalBinarySize64()
+		}
+	}
+	nKeys := uint64(len(data)-ptr) / uint64(swkSize)
+	if nRlk > nKeys || nGalEls+nRlk != nKeys || uint64(len(data)-ptr)%uint64(swkSize) != 0 {
+		return nil, fmt.Errorf("UnMarshalSeededEvaluationKey: %v bytes do not match %v relinearization and %v rotation keys",
+			len(data)-ptr, nRlk, nGalEls)
+	}
+
+	evk.Rlk = &rlwe.RelinearizationKey{Keys: make([]*rlwe.SwitchingKey, nRlk)}
+	for i := range evk.Rlk.Keys {
+		evk.Rlk.Keys[i] = rlwe.NewSwitchingKey(params.Parameters, levelQ, levelP)
+	}
+	evk.Rtks = rlwe.NewRotationKeySet(params.Parameters, evk.GaloisElements)
+
+	prng, err := utils.NewKeyedPRNG(evk.Seed)
+	if err != nil {
+		return nil, err
+	}
+	sampler := ringqp.NewUniformSampler(prng, *params.RingQP()).AtLevel(levelQ, levelP)
+	ringQP := params.RingQP().AtLevel(levelQ, levelP)
+	for _, swk := range evk.switchingKeys() {
+		for i := range swk.Value {
+			for j := range swk.Value[i] {
+				ct := &swk.Value[i][j]
+				inc, err := decodeQPPoly(&ct.Value[0], data[ptr:])
+				if err != nil {
+					return nil, fmt.Errorf("UnMarshalSeededEvaluationKey: %w", err)
+				}
+				ptr += inc
+
+				// same sampling as the symmetric encryption of zero in the QP basis
+				sampler.Read(ct.Value[1])
+				if !ct.IsNTT {
+					ringQP.INTT(ct.Value[1], ct.Value[1])
+				}
+			}
+		}
+	}
+	return evk, nil
+}
+
+// Decodes $data in $p after checking the length and the headers (degree and level) against
+// the shape of $p, as the lattigo decoding trusts them
+func decodeQPPoly(p *ringqp.Poly, data []byte) (int, error) {
+	size := p.MarshalBinarySize64()
+	if len(data) < size {
+		return 0, fmt.Errorf("data too short")
+	}
+	ptr := 2
+	for k, pol := range []*ring.Poly{p.Q, p.P} {
+		if (pol != nil) != (data[k] == 1) {
+			return 0, fmt.Errorf("invalid polynomial encoding")
+		}
+		if pol == nil {
+			continue
+		}
+		if !checkPolyHeader(data[ptr:], pol.N(), pol.Level()) {
+			return 0, fmt.Errorf("invalid polynomial encoding")
+		}
+		ptr += pol.MarshalBinarySize64()
+	}
+	return p.Decode64(data[:size])
+}
+
+// Checks the degree and level of an encoded ring.Poly
+func checkPolyHeader(data []byte, N, level int) bool {
+	return len(data) >= 5 && int(binary.BigEndian.Uint32(data)) == N && int(data[4]) == level
+}
+
+func appendUint64(data []byte, v uint64) []byte {
+	for i := 0; i < 8; i++ {
+		data = append(data, byte(v>>(8*i)))
+	}
+	return data
+}
+
+func readUint64(data []byte, ptr int) (uint64, int, error) {
+	if ptr < 0 || len(data)-ptr < 8 {
+		return 0, ptr, fmt.Errorf("data too short")
+	}
+	v := uint64(0)
+	for i := 0; i < 8; i++ {
+		v |= uint64(data[ptr+i]) << (8 * i)
+	}
+	return v, ptr + 8, nil
+}
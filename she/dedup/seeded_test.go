@@ -0,0 +1,170 @@
+package dedup
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tuneinsight/lattigo/v4/bfv"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+func newSeededTestParams(t *testing.T) (bfv.Parameters, *rlwe.SecretKey, []byte) {
+	t.Helper()
+	params, err := bfv.NewParametersFromLiteral(bfv.PN12QP109)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed, err := NewSeed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return params, bfv.NewKeyGenerator(params).GenSecretKey(), seed
+}
+
+func TestSeededCtxArrayRoundTrip(t *testing.T) {
+	params, sk, seed := newSeededTestParams(t)
+	enc, err := NewSeededEncryptor(params, sk, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder := bfv.NewEncoder(params)
+	ctxs := make([]*rlwe.Ciphertext, 3)
+	for i := range ctxs {
+		ctxs[i] = enc.EncryptNew(encoder.EncodeNew([]uint64{uint64(i), 1, 2}, params.MaxLevel()))
+	}
+
+	seeded, err := MarshalSeededCtxArray(seed, ctxs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := UnMarshalSeededCtxArray(params, seeded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := MarshalCtxArray(ctxs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotData, err := MarshalCtxArray(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotData) != len(want) {
+		t.Fatalf("got %v ciphertexts, want %v", len(gotData), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(gotData[i], want[i]) {
+			t.Errorf("ciphertext %v differs after the seeded round trip", i)
+		}
+		if 2*len(seeded[i+1]) > len(want[i]) {
+			t.Errorf("ciphertext %v: seeded size %v is not half of %v", i, len(seeded[i+1]), len(want[i]))
+		}
+	}
+}
+
+func TestUnMarshalSeededCtxArrayMalformed(t *testing.T) {
+	params, sk, seed := newSeededTestParams(t)
+	enc, err := NewSeededEncryptor(params, sk, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := enc.EncryptNew(bfv.NewEncoder(params).EncodeNew([]uint64{1}, params.MaxLevel()))
+	data, err := MarshalSeededCtxArray(seed, []*rlwe.Ciphertext{ctx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c0 := data[1]
+	badLevel := append([]byte{}, c0...)
+	badLevel[4] = byte(params.MaxLevel() + 1)
+	badDegree := append([]byte{}, c0...)
+	badDegree[0] = 1
+
+	tests := map[string][][]byte{
+		"missing seed": {},
+		"empty":        {seed, {}},
+		"header only":  {seed, c0[:5]},
+		"truncated":    {seed, c0[:len(c0)-1]},
+		"bad level":    {seed, badLevel},
+		"bad degree":   {seed, badDegree},
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := UnMarshalSeededCtxArray(params, data); err == nil {
+				t.Errorf("got no error")
+			}
+		})
+	}
+}
+
+func TestSeededEvaluationKeyRoundTrip(t *testing.T) {
+	params, sk, seed := newSeededTestParams(t)
+	galEls := []uint64{params.GaloisElementForColumnRotationBy(2), params.GaloisElementForColumnRotationBy(1), params.GaloisElementForRowRotation()}
+	evk, err := GenSeededEvaluationKey(params, sk, seed, galEls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := evk.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := UnMarshalSeededEvaluationKey(params, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Seed, seed) {
+		t.Errorf("seed differs after the round trip")
+	}
+	if len(got.GaloisElements) != len(galEls) {
+		t.Errorf("got %v Galois elements, want %v", len(got.GaloisElements), len(galEls))
+	}
+	if !got.Rlk.Equals(evk.Rlk) {
+		t.Errorf("relinearization key differs after the round trip")
+	}
+	if !got.Rtks.Equals(evk.Rtks) {
+		t.Errorf("rotation keys differ after the round trip")
+	}
+}
+
+func TestUnMarshalSeededEvaluationKeyMalformed(t *testing.T) {
+	params, sk, seed := newSeededTestParams(t)
+	evk, err := GenSeededEvaluationKey(params, sk, seed, []uint64{params.GaloisElementForRowRotation()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := evk.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// offsets of the header fields, see MarshalBinary
+	nGalEls, galEl, nRlk, keys := SEED_SIZE, SEED_SIZE+8, SEED_SIZE+16, SEED_SIZE+24
+	modified := func(offset int, b ...byte) []byte {
+		out := append([]byte{}, data...)
+		copy(out[offset:], b)
+		return out
+	}
+
+	tests := map[string][]byte{
+		"empty":                {},
+		"seed only":            data[:SEED_SIZE],
+		"truncated count":      data[:nGalEls+4],
+		"truncated elements":   data[:galEl+4],
+		"missing rlk count":    data[:nRlk],
+		"no keys":              data[:keys],
+		"truncated keys":       data[:len(data)-1],
+		"trailing bytes":       append(append([]byte{}, data...), 0),
+		"huge Galois count":    modified(nGalEls, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff),
+		"huge rlk count":       modified(nRlk, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff),
+		"too many rlk":         modified(nRlk, 2),
+		"invalid poly flags":   modified(keys, 0, 0),
+		"invalid poly degree":  modified(keys+2, 0, 1),
+		"invalid poly level":   modified(keys+6, 0x7f),
+		"unsorted Galois elts": append(append(append(append([]byte{}, data[:nGalEls]...), 2, 0, 0, 0, 0, 0, 0, 0), data[galEl:nRlk]...), data[galEl:]...),
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := UnMarshalSeededEvaluationKey(params, data); err == nil {
+				t.Errorf("got no error")
+			}
+		})
+	}
+}
@@ -18,7 +18,7 @@ var VERBOSE = false
 type PlainStrip struct {
 	CtxPerTemplate int // number of ciphertexts, first dimension of Strips
 	SlotPerCtx     int // number of batched elements from each record in a ciphertext, second dimension of Strips, must be a power of 2 ($SlotPerCtx <= N/2)
-	// The template size must be equal to $CtxPerTemplate*$SlotPerCtx
+	// Templates are zero padded to $CtxPerTemplate*$SlotPerCtx
 	RecPerCtx int // number of records per ciphertext, N = SlotPerCtx * recPerCtx
 
 	Strips    [][]int64
@@ -44,10 +44,27 @@ func (strip *PlainStrip) GetRecord(idx int) []int64 {
 	return out
 }
 
-// Takes m records of size TS where TS = CN*BN and stripes them into m/recPerCtx PlainStrips
+// Zero pads records of size TS to CtxPerTemplate*SlotsPerCtx
+// Padding with zeros is mask-aware: padded mask slots are 0, so padded slots
+// neither contribute to the distance nor to the mask size.
+func PadRecords(params *JanusParams, records [][]int64) ([][]int64, error) {
+	size := params.CtxPerTemplate * params.SlotsPerCtx
+	out := make([][]int64, len(records))
+	for i := range records {
+		if len(records[i]) > size {
+			return nil, fmt.Errorf("stripeRecords: %w. TS(%v) > CtxPerTemplate(%v)*SlotsPerCtx(%v)", ErrParamMismatch, len(records[i]), params.CtxPerTemplate, params.SlotsPerCtx)
+		}
+		out[i] = PadTemplate(records[i], size)
+	}
+	return out, nil
+}
+
+// Takes m records of size TS where TS <= CN*BN and stripes them into m/recPerCtx PlainStrips
+// Records are zero padded to CN*BN.
 func StripRecords(params *JanusParams, records [][]int64) ([]*PlainStrip, error) {
-	if len(records[0]) != params.CtxPerTemplate*params.SlotsPerCtx {
-		return nil, fmt.Errorf("stripeRecords: mismatching parameters. TS(%v) != CtxPerTemplate(%v)*SlotsPerCtx(%v)", len(records[0]), params.CtxPerTemplate, params.SlotsPerCtx)
+	records, err := PadRecords(params, records)
+	if err != nil {
+		return nil, err
 	}
 
 	if VERBOSE {
@@ -96,8 +113,8 @@ func StripRecords(params *JanusParams, records [][]int64) ([]*PlainStrip, error)
 
 // Replicate a single template (N/slotPerCtx elements) into a PlainStrip
 func ReplicateAsStripeRecords(params *JanusParams, record []int64) (*PlainStrip, error) {
-	if len(record) != params.CtxPerTemplate*params.SlotsPerCtx {
-		return nil, fmt.Errorf("stripeRecords: mismatching parameters. TS(%v) != CtxPerTemplate(%v)*SlotsPerCtx(%v)", len(record), params.CtxPerTemplate, params.SlotsPerCtx)
+	if len(record) > params.CtxPerTemplate*params.SlotsPerCtx {
+		return nil, fmt.Errorf("stripeRecords: %w. TS(%v) > CtxPerTemplate(%v)*SlotsPerCtx(%v)", ErrParamMismatch, len(record), params.CtxPerTemplate, params.SlotsPerCtx)
 	}
 	recPerCtx := params.Nbfv / params.SlotsPerCtx
 
@@ -108,7 +125,7 @@ func ReplicateAsStripeRecords(params *JanusParams, record []int64) (*PlainStrip,
 
 	strip, err := StripRecords(params, replicates)
 	if len(strip) > 1 {
-		return nil, fmt.Errorf("ReplicateAsStripeRecords: failed")
+		return nil, fmt.Errorf("ReplicateAsStripeRecords: %w, the replicates span %v strips", ErrPacking, len(strip))
 	}
 
 	return strip[0], err
@@ -164,6 +181,22 @@ func (base *PlainStrip) LogicNot() *PlainStrip {
 	return out
 }
 
+func (base *PlainStrip) Negate() *PlainStrip {
+	out := &PlainStrip{
+		CtxPerTemplate: base.CtxPerTemplate,
+		SlotPerCtx:     base.SlotPerCtx,
+		RecPerCtx:      base.RecPerCtx,
+		Strips:         make([][]int64, base.CtxPerTemplate),
+	}
+	for i := 0; i < base.CtxPerTemplate; i++ {
+		out.Strips[i] = make([]int64, len(base.Strips[i]))
+		for j := 0; j < len(base.Strips[i]); j++ {
+			out.Strips[i][j] = -base.Strips[i][j]
+		}
+	}
+	return out
+}
+
 func StripMul(a, b *PlainStrip) *PlainStrip {
 	out := &PlainStrip{
 		CtxPerTemplate: a.CtxPerTemplate,
@@ -197,10 +230,35 @@ func (base *CtxStrip) Mul(HE *HEHandler, target *PlainStrip) {
 	}
 }
 
+func (base *CtxStrip) CopyNew() *CtxStrip {
+	out := &CtxStrip{
+		CtxPerTemplate: base.CtxPerTemplate,
+		SlotPerCtx:     base.SlotPerCtx,
+		RecPerCtx:      base.RecPerCtx,
+		Strips:         make([]*rlwe.Ciphertext, len(base.Strips)),
+	}
+	for i := range base.Strips {
+		out.Strips[i] = base.Strips[i].CopyNew()
+	}
+	return out
+}
+
 // Computes the sum of all TS slots of each template
 // This function randomizes internal slots that do not contain the sum values to
 // prevent information leakage
 func (base *CtxStrip) StripeSum(HE *HEHandler) *rlwe.Ciphertext {
+	sum := base.stripeSum(HE)
+
+	// The values in C[x] where x != k*slotPerCtx are not needed in the computation,
+	// but may leak information. We randomize them.
+	r := InternalSlotRandomizer(base.SlotPerCtx, HE)
+	HE.Evaluator.Add(sum, r, sum)
+
+	return sum
+}
+
+// Computes the sum of all TS slots of each template without randomizing internal slots
+func (base *CtxStrip) stripeSum(HE *HEHandler) *rlwe.Ciphertext {
 	// Compute the sum of all CtxPerTemplate ciphertexts
 	ctxs := base.Strips[:]
 	for len(ctxs) > 1 {
@@ -221,14 +279,10 @@ func (base *CtxStrip) StripeSum(HE *HEHandler) *rlwe.Ciphertext {
 	// compute the sum of SlotPerCtx slots in the strip
 	HE.Evaluator.InnerSum(ctxs[0], 1, base.SlotPerCtx, ctxs[0])
 
-	// The values in C[x] where x != k*slotPerCtx are not needed in the computation,
-	// but may leak information. We randomize them.
-	r := InternalSlotRandomizer(base.SlotPerCtx, HE)
-	HE.Evaluator.Add(ctxs[0], r, ctxs[0])
-
 	return ctxs[0]
 }
 
+// Squared Euclidean distance between the strip and the target, computed in place
 func (base *CtxStrip) EucDistance(HE *HEHandler, target *PlainStrip) (dist *rlwe.Ciphertext) {
 	base.Sub(HE, target)
 	base.Square(HE)
@@ -236,14 +290,27 @@ func (base *CtxStrip) EucDistance(HE *HEHandler, target *PlainStrip) (dist *rlwe
 	return dist
 }
 
+// Distance between the query and each record of the DB, the DB is not modified
 func (query *PlainStrip) EuclideanIdentification(HE *HEHandler, dbStrip []*CtxStrip) []*rlwe.Ciphertext {
 	out := make([]*rlwe.Ciphertext, len(dbStrip))
 	for i := 0; i < len(dbStrip); i++ {
-		out[i] = dbStrip[i].EucDistance(HE, query)
+		out[i] = dbStrip[i].CopyNew().EucDistance(HE, query)
 	}
 	return out
 }
 
+// Computes the distance between the query and the $recIdx'th record of the strip
+// All other slots are masked out (randomized) to avoid leaking the distance to
+// other records of the strip. The strip is not modified.
+func (base *CtxStrip) EucVerify(HE *HEHandler, target *PlainStrip, recIdx int) *rlwe.Ciphertext {
+	strip := base.CopyNew()
+	strip.Sub(HE, target)
+	strip.Square(HE)
+	dist := strip.stripeSum(HE)
+	HE.Evaluator.Add(dist, RecordSlotRandomizer(recIdx, base.SlotPerCtx, HE), dist)
+	return dist
+}
+
 func NHammingDistance(
 	HE *HEHandler,
 	x *PlainStrip, //query data
@@ -260,14 +327,16 @@ func NHammingDistance(
 
 	out := make([]*rlwe.Ciphertext, len(ymask))
 	for i := 0; i < len(ymask); i++ {
-		// This destroys the DB.
-		// To support multiple queries, temp variables should be used
-		y_dot_ymask[i].Mul(HE, xbar_dot_xmask)
-		ybar_dot_ymask[i].Mul(HE, x_dot_xmask)
-		ymask[i].Mul(HE, xmask)
+		// the products are computed on copies, the DB is not modified
+		yYmask := y_dot_ymask[i].CopyNew()
+		yBarYmask := ybar_dot_ymask[i].CopyNew()
+		mask := ymask[i].CopyNew()
+		yYmask.Mul(HE, xbar_dot_xmask)
+		yBarYmask.Mul(HE, x_dot_xmask)
+		mask.Mul(HE, xmask)
 
-		dist := HE.Evaluator.AddNew(y_dot_ymask[i].StripeSum(HE), ybar_dot_ymask[i].StripeSum(HE))
-		maskSize := ymask[i].StripeSum(HE)
+		dist := HE.Evaluator.AddNew(yYmask.StripeSum(HE), yBarYmask.StripeSum(HE))
+		maskSize := mask.StripeSum(HE)
 
 		// Similarity is computed as follows:
 		//   dist/maskSize < MATCH_THRESHOLD/100 =>
@@ -282,6 +351,107 @@ func NHammingDistance(
 	return out
 }
 
+// Normalized Hamming distance between the query and the $recIdx'th record of a single strip
+// All other slots are masked out (randomized). The strips are not modified.
+func NHammingVerify(
+	HE *HEHandler,
+	x *PlainStrip, //query data
+	xmask *PlainStrip, // query mask
+	y_dot_ymask *CtxStrip, // y.(ymask)
+	ybar_dot_ymask *CtxStrip, // ~y.(ymask)
+	ymask *CtxStrip, // ymask
+	recIdx int,
+) *rlwe.Ciphertext {
+	x_dot_xmask := StripMul(x, xmask)
+	xbar_dot_xmask := StripMul(x.LogicNot(), xmask)
+
+	yYmask := y_dot_ymask.CopyNew()
+	yBarYmask := ybar_dot_ymask.CopyNew()
+	mask := ymask.CopyNew()
+	yYmask.Mul(HE, xbar_dot_xmask)
+	yBarYmask.Mul(HE, x_dot_xmask)
+	mask.Mul(HE, xmask)
+
+	dist := HE.Evaluator.AddNew(yYmask.stripeSum(HE), yBarYmask.stripeSum(HE))
+	maskSize := mask.stripeSum(HE)
+	score := HE.Evaluator.SubNew(HE.Evaluator.MulScalarNew(dist, 100), HE.Evaluator.MulScalarNew(maskSize, MATCH_THRESHOLD))
+
+	HE.Evaluator.Add(score, RecordSlotRandomizer(recIdx, ymask.SlotPerCtx, HE), score)
+	return score
+}
+
+// Computes the face score $threshold - <x, y> between the query x and each record y of the DB
+// The inner product is computed with the negated query, so that the score only requires
+// a plaintext multiplication and a plaintext addition.
+// if score < 0, then the sample is a match (note that negative values are > bfv.p/2)
+// The DB is not modified.
+func FaceIdentification(HE *HEHandler, x *PlainStrip, threshold int64, dbStrip []*CtxStrip) []*rlwe.Ciphertext {
+	negX := x.Negate()
+	thr := faceThresholdPlaintext(HE, threshold)
+	out := make([]*rlwe.Ciphertext, len(dbStrip))
+	for i := 0; i < len(dbStrip); i++ {
+		strip := dbStrip[i].CopyNew()
+		strip.Mul(HE, negX)
+		out[i] = strip.StripeSum(HE)
+		HE.Evaluator.Add(out[i], thr, out[i])
+	}
+	return out
+}
+
+// Face score between the query and the $recIdx'th record of a single strip
+// All other slots are masked out (randomized). The strip is not modified.
+func FaceVerify(HE *HEHandler, x *PlainStrip, threshold int64, y *CtxStrip, recIdx int) *rlwe.Ciphertext {
+	strip := y.CopyNew()
+	strip.Mul(HE, x.Negate())
+	score := strip.stripeSum(HE)
+	HE.Evaluator.Add(score, faceThresholdPlaintext(HE, threshold), score)
+	HE.Evaluator.Add(score, RecordSlotRandomizer(recIdx, y.SlotPerCtx, HE), score)
+	return score
+}
+
+func faceThresholdPlaintext(HE *HEHandler, threshold int64) *rlwe.Plaintext {
+	data := make([]int64, HE.Params.N())
+	for i := range data {
+		data[i] = threshold
+	}
+	return HE.Encoder.EncodeNew(data, HE.Params.MaxLevel())
+}
+
+// Merges the outputs of StripeSum into ceil(len(ctxs)/slotPerCtx) ciphertexts
+// Each output only holds useful values in the slots k*slotPerCtx, the others are masked out
+// and the j'th output of each group is rotated by j slots before adding them together.
+// The packed ciphertext p holds the sum of record k of output p*slotPerCtx+j in the slot k*slotPerCtx+j.
+// Masking requires a plaintext multiplication which consumes noise budget.
+func PackResults(HE *HEHandler, ctxs []*rlwe.Ciphertext, slotPerCtx int) []*rlwe.Ciphertext {
+	if slotPerCtx == 1 {
+		return ctxs
+	}
+
+	data := make([]uint64, HE.Params.N())
+	for i := 0; i < len(data); i += slotPerCtx {
+		data[i] = 1
+	}
+	mask := HE.Encoder.EncodeMulNew(data, HE.Params.MaxLevel())
+
+	out := make([]*rlwe.Ciphertext, 0, (len(ctxs)+slotPerCtx-1)/slotPerCtx)
+	for st := 0; st < len(ctxs); st += slotPerCtx {
+		var packed *rlwe.Ciphertext
+		for j := 0; j < slotPerCtx && st+j < len(ctxs); j++ {
+			ctx := HE.Evaluator.MulNew(ctxs[st+j], mask)
+			if j > 0 {
+				ctx = HE.Evaluator.RotateColumnsNew(ctx, -j)
+			}
+			if packed == nil {
+				packed = ctx
+			} else {
+				HE.Evaluator.Add(packed, ctx, packed)
+			}
+		}
+		out = append(out, packed)
+	}
+	return out
+}
+
 func BPprocessIdReq(encDist []*rlwe.Ciphertext, HE *HEHandler, slotPerCtx int) (answer []uint64) {
 	answer = make([]uint64, 0, HE.Params.N()*len(encDist)/slotPerCtx)
 	for _, ctx := range encDist {
@@ -292,3 +462,38 @@ func BPprocessIdReq(encDist []*rlwe.Ciphertext, HE *HEHandler, slotPerCtx int) (
 	}
 	return answer
 }
+
+// Decrypts the verification distance of the $userID'th record
+func BPprocessVerifyReq(encDist *rlwe.Ciphertext, HE *HEHandler, params *JanusParams, userID int) uint64 {
+	recPerCtx := params.Nbfv / params.SlotsPerCtx
+	raw_answer := HE.Encoder.DecodeUintNew(HE.Decryptor.DecryptNew(encDist))
+	return raw_answer[(userID%recPerCtx)*params.SlotsPerCtx]
+}
+
+// Decrypts the distances packed by PackResults
+// $numOutputs is the number of ciphertexts before packing.
+func BPprocessPackedIdReq(encDist []*rlwe.Ciphertext, HE *HEHandler, slotPerCtx int, numOutputs int) (answer []uint64) {
+	recPerCtx := HE.Params.N() / slotPerCtx
+	answer = make([]uint64, recPerCtx*numOutputs)
+	for p, ctx := range encDist {
+		raw_answer := HE.Encoder.DecodeUintNew(HE.Decryptor.DecryptNew(ctx))
+		for j := 0; j < slotPerCtx && p*slotPerCtx+j < numOutputs; j++ {
+			for k := 0; k < recPerCtx; k++ {
+				answer[(p*slotPerCtx+j)*recPerCtx+k] = raw_answer[k*slotPerCtx+j]
+			}
+		}
+	}
+	return answer
+}
+
+// Decrypts the identification distances of the DB users according to the Janus parameters
+func BPprocessJanusIdReq(encDist []*rlwe.Ciphertext, HE *HEHandler, params *JanusParams) ([]uint64, error) {
+	if len(encDist) != params.NumOutputs() {
+		return nil, fmt.Errorf("BPprocessJanusIdReq: %w, got %v ciphertexts for DB[%v], expected %v",
+			ErrParamMismatch, len(encDist), params.DbSize, params.NumOutputs())
+	}
+	if params.PackResults {
+		return BPprocessPackedIdReq(encDist, HE, params.SlotsPerCtx, params.NumStrips())[:params.DbSize], nil
+	}
+	return BPprocessIdReq(encDist, HE, params.SlotsPerCtx)[:params.DbSize], nil
+}
@@ -0,0 +1,82 @@
+package dedup
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/tuneinsight/lattigo/v4/bfv"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+func TestPackResultsMatchesGroundTruth(t *testing.T) {
+	for _, bioType := range []string{"finger", "iris", "face"} {
+		t.Run(bioType, func(t *testing.T) {
+			bio := testParams(bioType)
+			bio.PackResults = true
+			// several outputs are merged in a single ciphertext
+			bio.DbSize = 3000
+			bpHE, janus := newTestJanus(t, bio)
+			if bio.NumStrips() < 2 || bio.NumOutputs() != 1 {
+				t.Fatalf("got %v strips packed in %v outputs", bio.NumStrips(), bio.NumOutputs())
+			}
+			// the inner sum keys and a single column rotation key per packed output
+			if got, want := len(bio.GaloisElements(bpHE.Params)), len(bio.innerSumRotations())+bio.SlotsPerCtx-1; got != want {
+				t.Errorf("got %v Galois elements, want %v", got, want)
+			}
+			query := setupTestDB(t, janus)
+			checkIdentification(t, bpHE, janus, query)
+		})
+	}
+}
+
+func TestValidateRejectsPackResultsWithoutNoiseBudget(t *testing.T) {
+	// the hand-picked parameters of the paper do not have the noise budget of the masking
+	pl := bfv.PN12QP101pq
+	pl.T = 4169729
+	params, err := bfv.NewParametersFromLiteral(pl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bio := testParams("finger")
+	bio.Nbfv = params.N()
+	if err := bio.Validate(params); err != nil {
+		t.Fatalf("Validate without PackResults: %v", err)
+	}
+	bio.PackResults = true
+	if err := bio.Validate(params); !errors.Is(err, ErrParamMismatch) {
+		t.Errorf("Validate with PackResults: got %v, want ErrParamMismatch", err)
+	}
+}
+
+func TestBPprocessJanusIdReqChecksResponseLength(t *testing.T) {
+	for _, pack := range []bool{false, true} {
+		bio := testParams("finger")
+		bio.PackResults = pack
+		bio.DbSize = 3000
+		bpHE, janus := newTestJanus(t, bio)
+		query := setupTestDB(t, janus)
+		encDist, err := janus.Identification(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, short := range [][]*rlwe.Ciphertext{nil, encDist[:len(encDist)-1], append(encDist, encDist[0])} {
+			if _, err := BPprocessJanusIdReq(short, bpHE, bio); !errors.Is(err, ErrParamMismatch) {
+				t.Errorf("PackResults %v, %v ciphertexts: got %v, want ErrParamMismatch", pack, len(short), err)
+			}
+			if _, err := BPprocessTopK(short, nil, bpHE, bio, 5); !errors.Is(err, ErrParamMismatch) {
+				t.Errorf("BPprocessTopK, PackResults %v, %v ciphertexts: got %v, want ErrParamMismatch", pack, len(short), err)
+			}
+		}
+	}
+}
+
+func TestIdentificationKeepsDB(t *testing.T) {
+	// a second identification (and verification) against the same encrypted DB
+	for _, bio := range []string{"finger", "iris", "face"} {
+		t.Run(bio, func(t *testing.T) {
+			bpHE, janus := newTestJanus(t, testParams(bio))
+			query := setupTestDB(t, janus)
+			checkRepeatedIdentification(t, bpHE, janus, query)
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package dedup
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// Cost model used to select the strip packing parameters
+// Costs are in arbitrary units (e.g., ms for N=4096), only their ratios matter.
+type StripCostModel struct {
+	MulCost      float64 // ciphertext-plaintext or ciphertext-ciphertext multiplication (incl. relinearization)
+	AddCost      float64 // ciphertext addition
+	RotCost      float64 // ciphertext rotation (key switching)
+	TransferCost float64 // sending one output ciphertext from the RS to the BP
+}
+
+// Hand-picked relative costs (a rotation is a key switch, close to a relinearized multiplication),
+// they are not measured. BenchmarkScheme gives the actual identification latency of a plan.
+var DefaultStripCostModel = StripCostModel{
+	MulCost:      1.0,
+	AddCost:      0.02,
+	RotCost:      0.8,
+	TransferCost: 0.5,
+}
+
+type StripPlan struct {
+	CtxPerTemplate int
+	SlotsPerCtx    int
+	Padding        int // number of zero slots appended to each template
+	Strips         int // number of strips needed to store the DB
+	Cost           float64
+}
+
+func (plan StripPlan) String() string {
+	return fmt.Sprintf("Strip(%v x %v, padding %v, %v strips, cost %.2f)",
+		plan.CtxPerTemplate, plan.SlotsPerCtx, plan.Padding, plan.Strips, plan.Cost)
+}
+
+// Sets the strip parameters of $params according to the plan
+func (plan StripPlan) Apply(params *JanusParams) {
+	params.CtxPerTemplate = plan.CtxPerTemplate
+	params.SlotsPerCtx = plan.SlotsPerCtx
+}
+
+// Estimates the cost of identifying a query against $dbSize templates with the given strip geometry
+// Each strip requires CtxPerTemplate multiplications, CtxPerTemplate-1 additions,
+// log2(SlotsPerCtx) rotations (inner sum) and outputs a single ciphertext.
+func (cost StripCostModel) Estimate(ctxPerTemplate, slotsPerCtx, dbSize, nbfv int) (strips int, total float64) {
+	recPerCtx := nbfv / slotsPerCtx
+	strips = (dbSize + recPerCtx - 1) / recPerCtx
+	rotations := bits.Len(uint(slotsPerCtx)) - 1
+
+	perStrip := float64(ctxPerTemplate)*cost.MulCost +
+		float64(ctxPerTemplate-1)*cost.AddCost +
+		float64(rotations)*(cost.RotCost+cost.AddCost) +
+		cost.TransferCost
+	return strips, float64(strips) * perStrip
+}
+
+// Selects the power-of-two SlotsPerCtx minimizing the cost model
+// If $allowPadding is false, only geometries with TS == CtxPerTemplate*SlotsPerCtx are considered,
+// otherwise templates are zero padded to the next multiple of SlotsPerCtx.
+// Ties are broken in favor of the smallest SlotsPerCtx (fewer output ciphertexts).
+func PlanStrip(templateSize, dbSize, nbfv int, cost StripCostModel, allowPadding bool) (StripPlan, error) {
+	if templateSize <= 0 || dbSize <= 0 {
+		return StripPlan{}, fmt.Errorf("PlanStrip: invalid TS(%v) or DB size(%v)", templateSize, dbSize)
+	}
+	if !IsPowerOf2(nbfv) || nbfv < 2 {
+		return StripPlan{}, fmt.Errorf("PlanStrip: N(%v) must be a power of 2", nbfv)
+	}
+
+	best := StripPlan{}
+	found := false
+	for slots := 1; slots <= nbfv/2 && slots <= NextPow2(templateSize); slots *= 2 {
+		ctxPerTemplate := (templateSize + slots - 1) / slots
+		padding := ctxPerTemplate*slots - templateSize
+		if padding != 0 && !allowPadding {
+			continue
+		}
+
+		strips, total := cost.Estimate(ctxPerTemplate, slots, dbSize, nbfv)
+		if !found || total < best.Cost {
+			best = StripPlan{
+				CtxPerTemplate: ctxPerTemplate,
+				SlotsPerCtx:    slots,
+				Padding:        padding,
+				Strips:         strips,
+				Cost:           total,
+			}
+			found = true
+		}
+	}
+	if !found {
+		return StripPlan{}, fmt.Errorf("PlanStrip: no strip geometry for TS(%v) and N(%v)", templateSize, nbfv)
+	}
+	return best, nil
+}
+
+// Zero pads a template to $size elements
+func PadTemplate(record []int64, size int) []int64 {
+	if len(record) >= size {
+		return record
+	}
+	out := make([]int64, size)
+	copy(out, record)
+	return out
+}
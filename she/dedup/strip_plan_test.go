@@ -0,0 +1,77 @@
+package dedup
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestPlanStrip(t *testing.T) {
+	const nbfv = 4096
+	for _, ts := range []int{64, 60, 250} {
+		for _, allowPadding := range []bool{true, false} {
+			plan, err := PlanStrip(ts, 1000, nbfv, DefaultStripCostModel, allowPadding)
+			if err != nil {
+				t.Fatalf("TS %v, padding %v: %v", ts, allowPadding, err)
+			}
+			size := plan.CtxPerTemplate * plan.SlotsPerCtx
+			if !IsPowerOf2(plan.SlotsPerCtx) || size < ts || plan.Padding != size-ts || plan.Padding >= plan.SlotsPerCtx {
+				t.Errorf("TS %v, padding %v: invalid plan %v", ts, allowPadding, plan)
+			}
+			if !allowPadding && plan.Padding != 0 {
+				t.Errorf("TS %v: padded plan %v while padding is not allowed", ts, plan)
+			}
+		}
+	}
+
+	if _, err := PlanStrip(0, 1000, nbfv, DefaultStripCostModel, true); err == nil {
+		t.Errorf("PlanStrip accepted TS 0")
+	}
+	if _, err := PlanStrip(64, 1000, 3000, DefaultStripCostModel, true); err == nil {
+		t.Errorf("PlanStrip accepted N 3000")
+	}
+}
+
+func TestPadRecords(t *testing.T) {
+	params := &JanusParams{CtxPerTemplate: 16, SlotsPerCtx: 4}
+	records := [][]int64{{1, 2, 3}, make([]int64, 64)}
+	padded, err := PadRecords(params, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range padded {
+		if len(padded[i]) != 64 {
+			t.Errorf("record %v: got size %v, want 64", i, len(padded[i]))
+		}
+		for j := len(records[i]); j < len(padded[i]); j++ {
+			if padded[i][j] != 0 {
+				t.Errorf("record %v: padding slot %v is %v", i, j, padded[i][j])
+			}
+		}
+	}
+	if fmt.Sprint(padded[0][:3]) != fmt.Sprint(records[0]) {
+		t.Errorf("padding changed the record: got %v, want %v", padded[0][:3], records[0])
+	}
+
+	if _, err := PadRecords(params, [][]int64{make([]int64, 65)}); !errors.Is(err, ErrParamMismatch) {
+		t.Errorf("PadRecords of a too large record: got %v, want ErrParamMismatch", err)
+	}
+}
+
+// The encrypted scores of padded templates match the plaintext scores of the unpadded ones.
+// For iris, the zero padded mask slots leave the mask size of the normalized distance unchanged.
+func TestPaddedIdentificationMatchesGroundTruth(t *testing.T) {
+	for _, bioType := range []string{"finger", "iris"} {
+		for _, ts := range []int{60, 250} {
+			t.Run(fmt.Sprintf("%v/TS%v", bioType, ts), func(t *testing.T) {
+				bio := testParams(bioType)
+				bio.TemplateSize = ts
+				bio.SlotsPerCtx = 8
+				bio.CtxPerTemplate = (ts + bio.SlotsPerCtx - 1) / bio.SlotsPerCtx
+				bpHE, janus := newTestJanus(t, bio)
+				query := setupTestDB(t, janus)
+				checkIdentification(t, bpHE, janus, query)
+			})
+		}
+	}
+}
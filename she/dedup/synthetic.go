@@ -0,0 +1,403 @@
+package dedup
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// Number of radial rows of a synthetic iris code (when TS is a multiple), each row
+// holds TS/IRIS_RADIAL_ROWS angular samples
+const IRIS_RADIAL_ROWS = 8
+
+// Number of features (Gabor orientations) of a FingerCode sector
+const FINGERCODE_ORIENTATIONS = 8
+
+// Intra-class variability and acquisition defects of the synthetic generator
+type SyntheticConfig struct {
+	// iris
+	IrisBitCorrelation float64 // probability that a bit repeats its angular neighbor
+	IrisGenuineFlip    float64 // probability that a bit differs between two samples of the same iris
+	IrisOcclusion      float64 // mean fraction of the template occluded by the eyelids
+	IrisReflections    float64 // probability that a bit is masked by a specular reflection
+
+	// finger (FingerCode)
+	FingerNoise         float64 // std dev of the genuine feature noise, as a fraction of D
+	FingerMissingSector float64 // probability that a sector is masked (with quality masks)
+
+	// face
+	FaceNoise float64 // norm of the genuine embedding noise (cosine similarity about 1/sqrt(1 + FaceNoise^2))
+}
+
+var DefaultSyntheticConfig = SyntheticConfig{
+	IrisBitCorrelation:  0.75,
+	IrisGenuineFlip:     0.12,
+	IrisOcclusion:       0.15,
+	IrisReflections:     0.01,
+	FingerNoise:         0.05,
+	FingerMissingSector: 0.1,
+	FaceNoise:           1.0,
+}
+
+// Realistic synthetic biometric generator
+// Unlike NewRandomPlainBio (uniform values) and CreateFakeMatch (independent value flips),
+// the templates have the structure of the modality, so that the genuine and impostor score
+// distributions are close to the ones of real sensors:
+//
+//	iris: correlated bits along the angular direction, eyelid-shaped occlusion masks and reflections
+//	finger: FingerCode-like sectors of FINGERCODE_ORIENTATIONS correlated features, gaussian noise
+//	face: gaussian embeddings with gaussian intra-class noise
+//
+// The templates are drawn from the $rng of the generator, they are deterministic for a given seed.
+type SyntheticGenerator struct {
+	Config SyntheticConfig
+	rng    *rand.Rand
+}
+
+func NewSyntheticGenerator(rng *rand.Rand, config SyntheticConfig) *SyntheticGenerator {
+	return &SyntheticGenerator{
+		Config: config,
+		rng:    rng,
+	}
+}
+
+// Modalities supported by the synthetic generator
+type SyntheticModality interface {
+	// Template of a new subject
+	NewSynthetic(gen *SyntheticGenerator, bio *JanusParams) *PlainBio
+	// New sample of the subject enrolled with $base
+	NewGenuineSample(gen *SyntheticGenerator, bio *JanusParams, base *PlainBio) *PlainBio
+}
+
+func lookupSyntheticModality(bioType string) (SyntheticModality, error) {
+	m, err := LookupModality(bioType)
+	if err != nil {
+		return nil, err
+	}
+	sm, ok := m.(SyntheticModality)
+	if !ok {
+		return nil, fmt.Errorf("BioType %v (synthetic generator): %w", bioType, ErrUnsupportedModality)
+	}
+	return sm, nil
+}
+
+func (gen *SyntheticGenerator) NewTemplate(bio *JanusParams) (*PlainBio, error) {
+	sm, err := lookupSyntheticModality(bio.BioType)
+	if err != nil {
+		return nil, err
+	}
+	return sm.NewSynthetic(gen, bio), nil
+}
+
+func (gen *SyntheticGenerator) NewGenuineSample(bio *JanusParams, base *PlainBio) (*PlainBio, error) {
+	sm, err := lookupSyntheticModality(bio.BioType)
+	if err != nil {
+		return nil, err
+	}
+	return sm.NewGenuineSample(gen, bio, base), nil
+}
+
+// Generates the user template database with the synthetic generator
+func (janus *Janus) GenerateSyntheticUserDB(gen *SyntheticGenerator) error {
+	janus.db = make([]*PlainBio, janus.Params.DbSize)
+	for i := range janus.db {
+		var err error
+		if janus.db[i], err = gen.NewTemplate(janus.Params); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns a new sample of the user db[matchIdx] drawn by the synthetic generator
+func (janus *Janus) GenerateSyntheticQuery(gen *SyntheticGenerator, matchIdx int) (*PlainBio, error) {
+	return gen.NewGenuineSample(janus.Params, janus.db[matchIdx])
+}
+
+// Quality of a new acquisition: the intra-class noise of each sample is scaled by a factor
+// uniform in [0.5, 1.5), which widens the genuine score distribution
+func (gen *SyntheticGenerator) sampleQuality() float64 {
+	return 0.5 + gen.rng.Float64()
+}
+
+func (gen *SyntheticGenerator) bit() int64 {
+	return gen.rng.Int63n(2)
+}
+
+// Gaussian sample rounded and clamped to [0, maxVal)
+func (gen *SyntheticGenerator) clampedNormal(mean, sigma float64, maxVal int64) int64 {
+	v := int64(math.Round(mean + sigma*gen.rng.NormFloat64()))
+	if v < 0 {
+		return 0
+	}
+	if v > maxVal-1 {
+		return maxVal - 1
+	}
+	return v
+}
+
+// Radial rows and angular columns of an iris code of $ts bits
+func irisGeometry(ts int) (rows, cols int) {
+	if ts%IRIS_RADIAL_ROWS == 0 {
+		return IRIS_RADIAL_ROWS, ts / IRIS_RADIAL_ROWS
+	}
+	return 1, ts
+}
+
+// Iris code with bits correlated along the angular direction (row-major, the row 0 is
+// the closest to the pupil)
+func (irisModality) NewSynthetic(gen *SyntheticGenerator, bio *JanusParams) *PlainBio {
+	rows, cols := irisGeometry(bio.TemplateSize)
+	iris := &PlainBio{
+		BioMode: bio.BioType,
+		Data:    make([]int64, bio.TemplateSize),
+		MaxVal:  bio.SensorD,
+		HasMask: true,
+	}
+	for r := 0; r < rows; r++ {
+		iris.Data[r*cols] = gen.bit()
+		for c := 1; c < cols; c++ {
+			if gen.rng.Float64() < gen.Config.IrisBitCorrelation {
+				iris.Data[r*cols+c] = iris.Data[r*cols+c-1]
+			} else {
+				iris.Data[r*cols+c] = gen.bit()
+			}
+		}
+	}
+	iris.Mask = gen.irisMask(bio.TemplateSize)
+	return iris
+}
+
+// The bits of the enrolled iris are flipped with probability about IrisGenuineFlip, the
+// occlusions are drawn again
+func (irisModality) NewGenuineSample(gen *SyntheticGenerator, bio *JanusParams, base *PlainBio) *PlainBio {
+	iris := &PlainBio{
+		BioMode: base.BioMode,
+		Data:    make([]int64, len(base.Data)),
+		MaxVal:  base.MaxVal,
+		HasMask: true,
+	}
+	flip := gen.Config.IrisGenuineFlip * gen.sampleQuality()
+	for i := range iris.Data {
+		iris.Data[i] = base.Data[i]
+		if gen.rng.Float64() < flip {
+			iris.Data[i] = 1 - iris.Data[i]
+		}
+	}
+	iris.Mask = gen.irisMask(len(base.Data))
+	return iris
+}
+
+// Occlusion mask: the upper eyelid (about 2/3 of IrisOcclusion) and the lower eyelid (about 1/3)
+// cover an arc of the outer rows, specular reflections mask isolated bits
+func (gen *SyntheticGenerator) irisMask(ts int) []int64 {
+	rows, cols := irisGeometry(ts)
+	mask := make([]int64, ts)
+	for i := range mask {
+		mask[i] = 1
+	}
+	occlusion := gen.Config.IrisOcclusion
+	gen.occludeArc(mask, rows, cols, cols/4, 2*occlusion/3)
+	gen.occludeArc(mask, rows, cols, 3*cols/4, occlusion/3)
+	for i := range mask {
+		if gen.rng.Float64() < gen.Config.IrisReflections {
+			mask[i] = 0
+		}
+	}
+	return mask
+}
+
+// Masks an arc centered on the angular column $center covering about $area of the template
+func (gen *SyntheticGenerator) occludeArc(mask []int64, rows, cols, center int, area float64) {
+	area *= 0.5 + gen.rng.Float64()
+	depth := 0.5 + 0.5*gen.rng.Float64() // fraction of the rows covered by the eyelid
+	depthRows := int(math.Ceil(depth * float64(rows)))
+	width := int(math.Min(area/depth, 0.5) * float64(cols))
+	for r := rows - depthRows; r < rows; r++ {
+		for c := center - width/2; c < center-width/2+width; c++ {
+			mask[r*cols+(c+cols)%cols] = 0
+		}
+	}
+}
+
+// FingerCode-like template: each sector has a mean energy shared by its FINGERCODE_ORIENTATIONS
+// features, and each feature an orientation-specific offset
+func (fingerModality) NewSynthetic(gen *SyntheticGenerator, bio *JanusParams) *PlainBio {
+	d := float64(bio.SensorD)
+	finger := &PlainBio{
+		BioMode: bio.BioType,
+		Data:    make([]int64, bio.TemplateSize),
+		MaxVal:  bio.SensorD,
+		HasMask: bio.SensorHasMask,
+	}
+	for s := 0; s < bio.TemplateSize; s += FINGERCODE_ORIENTATIONS {
+		energy := d/2 + d/8*gen.rng.NormFloat64()
+		for i := s; i < s+FINGERCODE_ORIENTATIONS && i < bio.TemplateSize; i++ {
+			finger.Data[i] = gen.clampedNormal(energy, d/10, bio.SensorD)
+		}
+	}
+	finger.Mask = gen.fingerMask(bio)
+	return finger
+}
+
+// Each sector of the enrolled finger is shifted by a gaussian noise (pressure, contrast) and
+// each feature gets an additional gaussian noise of std dev about FingerNoise*D
+func (fingerModality) NewGenuineSample(gen *SyntheticGenerator, bio *JanusParams, base *PlainBio) *PlainBio {
+	sigma := gen.Config.FingerNoise * float64(base.MaxVal) * gen.sampleQuality()
+	finger := &PlainBio{
+		BioMode: base.BioMode,
+		Data:    make([]int64, len(base.Data)),
+		MaxVal:  base.MaxVal,
+		HasMask: base.HasMask,
+	}
+	for s := 0; s < len(base.Data); s += FINGERCODE_ORIENTATIONS {
+		shift := sigma / 2 * gen.rng.NormFloat64()
+		for i := s; i < s+FINGERCODE_ORIENTATIONS && i < len(base.Data); i++ {
+			finger.Data[i] = gen.clampedNormal(float64(base.Data[i])+shift, sigma, base.MaxVal)
+		}
+	}
+	finger.Mask = gen.fingerMask(bio)
+	return finger
+}
+
+// Quality mask: whole sectors are masked with probability FingerMissingSector
+func (gen *SyntheticGenerator) fingerMask(bio *JanusParams) []int64 {
+	if !bio.SensorHasMask {
+		return nil
+	}
+	mask := make([]int64, bio.TemplateSize)
+	for s := 0; s < bio.TemplateSize; s += FINGERCODE_ORIENTATIONS {
+		valid := int64(1)
+		if gen.rng.Float64() < gen.Config.FingerMissingSector {
+			valid = 0
+		}
+		for i := s; i < s+FINGERCODE_ORIENTATIONS && i < bio.TemplateSize; i++ {
+			mask[i] = valid
+		}
+	}
+	return mask
+}
+
+func (faceModality) NewSynthetic(gen *SyntheticGenerator, bio *JanusParams) *PlainBio {
+	emb := &PlainFloatBio{Data: make([]float64, bio.TemplateSize)}
+	for i := range emb.Data {
+		emb.Data[i] = gen.rng.NormFloat64()
+	}
+	emb.Normalize()
+	return NewPlainFaceBio(emb, bio.SensorD)
+}
+
+// The enrolled embedding is perturbed by a gaussian noise of norm about FaceNoise
+func (faceModality) NewGenuineSample(gen *SyntheticGenerator, bio *JanusParams, base *PlainBio) *PlainBio {
+	emb := base.FaceEmbedding()
+	sigma := gen.Config.FaceNoise * gen.sampleQuality() / math.Sqrt(float64(len(emb.Data)))
+	for i := range emb.Data {
+		emb.Data[i] += sigma * gen.rng.NormFloat64()
+	}
+	emb.Normalize()
+	return NewPlainFaceBio(emb, base.MaxVal)
+}
+
+// Genuine and impostor scores of a synthetic population
+type ScoreDistribution struct {
+	Genuine  []int64
+	Impostor []int64
+}
+
+// Computes the genuine and impostor scores of $bio.DbSize synthetic subjects: a new sample of
+// each subject is compared with its enrolled template (genuine) and with the templates of all
+// other subjects (impostor).
+func SyntheticScoreDistribution(bio *JanusParams, gen *SyntheticGenerator) (*ScoreDistribution, error) {
+	enrolled := make([]*PlainBio, bio.DbSize)
+	samples := make([]*PlainBio, bio.DbSize)
+	for i := range enrolled {
+		var err error
+		if enrolled[i], err = gen.NewTemplate(bio); err != nil {
+			return nil, err
+		}
+		if samples[i], err = gen.NewGenuineSample(bio, enrolled[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	dist := &ScoreDistribution{}
+	for i := range samples {
+		for j := range enrolled {
+			score := bio.ComputeScore(samples[i], enrolled[j])
+			if i == j {
+				dist.Genuine = append(dist.Genuine, score)
+			} else {
+				dist.Impostor = append(dist.Impostor, score)
+			}
+		}
+	}
+	return dist, nil
+}
+
+// Returns the mean and standard deviation of non-empty $scores
+func meanStdDev(scores []int64) (mean, sd float64, err error) {
+	if len(scores) == 0 {
+		return 0, 0, fmt.Errorf("meanStdDev: no scores")
+	}
+	for _, s := range scores {
+		mean += float64(s)
+	}
+	mean /= float64(len(scores))
+	for _, s := range scores {
+		sd += (float64(s) - mean) * (float64(s) - mean)
+	}
+	return mean, math.Sqrt(sd / float64(len(scores))), nil
+}
+
+// Returns the equal error rate and its threshold: a score <= threshold is accepted
+// FAR(t) is the fraction of accepted impostor scores, FRR(t) the fraction of rejected genuine scores.
+// Both classes must be non-empty (the DB needs at least 2 subjects for impostor scores).
+func (dist *ScoreDistribution) EqualErrorRate() (eer float64, threshold int64, err error) {
+	if len(dist.Genuine) == 0 || len(dist.Impostor) == 0 {
+		return 0, 0, fmt.Errorf("EqualErrorRate: %v genuine and %v impostor scores, both classes are required",
+			len(dist.Genuine), len(dist.Impostor))
+	}
+	thresholds := append(append([]int64{}, dist.Genuine...), dist.Impostor...)
+	sort.Slice(thresholds, func(i, j int) bool { return thresholds[i] < thresholds[j] })
+	genuine := append([]int64{}, dist.Genuine...)
+	impostor := append([]int64{}, dist.Impostor...)
+	sort.Slice(genuine, func(i, j int) bool { return genuine[i] < genuine[j] })
+	sort.Slice(impostor, func(i, j int) bool { return impostor[i] < impostor[j] })
+
+	best := math.Inf(1)
+	for _, t := range thresholds {
+		far := float64(sort.Search(len(impostor), func(i int) bool { return impostor[i] > t })) / float64(len(impostor))
+		frr := 1 - float64(sort.Search(len(genuine), func(i int) bool { return genuine[i] > t }))/float64(len(genuine))
+		if math.Abs(far-frr) < best {
+			best = math.Abs(far - frr)
+			eer, threshold = (far+frr)/2, t
+		}
+	}
+	return eer, threshold, nil
+}
+
+// Describes the score statistics, the statistics of an empty class are reported as n/a
+func (dist *ScoreDistribution) Describe() string {
+	describe := func(scores []int64) string {
+		mean, sd, err := meanStdDev(scores)
+		if err != nil {
+			return fmt.Sprintf("%v, mean n/a, std dev n/a", len(scores))
+		}
+		return fmt.Sprintf("%v, mean %.1f, std dev %.1f", len(scores), mean, sd)
+	}
+	out := fmt.Sprintf("Genuine scores:  %v\nImpostor scores: %v\n", describe(dist.Genuine), describe(dist.Impostor))
+
+	eer, threshold, err := dist.EqualErrorRate()
+	if err != nil {
+		return out + "Decidability d' = n/a, EER = n/a (no genuine or impostor scores)\n"
+	}
+	gMean, gSd, _ := meanStdDev(dist.Genuine)
+	iMean, iSd, _ := meanStdDev(dist.Impostor)
+	// decidability index, undefined when both classes have a single value
+	dPrime := "n/a"
+	if gSd > 0 || iSd > 0 {
+		dPrime = fmt.Sprintf("%.2f", math.Abs(iMean-gMean)/math.Sqrt((gSd*gSd+iSd*iSd)/2))
+	}
+	return out + fmt.Sprintf("Decidability d' = %v, EER = %.2f%% at threshold %v\n", dPrime, 100*eer, threshold)
+}
@@ -0,0 +1,51 @@
+package dedup
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestEqualErrorRate(t *testing.T) {
+	tests := []struct {
+		name          string
+		dist          ScoreDistribution
+		wantEER       float64
+		wantThreshold int64
+		wantErr       bool
+	}{
+		{"separated", ScoreDistribution{Genuine: []int64{1, 2}, Impostor: []int64{5, 6}}, 0, 2, false},
+		{"overlapping", ScoreDistribution{Genuine: []int64{1, 4}, Impostor: []int64{3, 6}}, 0.5, 3, false},
+		{"no impostor scores", ScoreDistribution{Genuine: []int64{1}}, 0, 0, true},
+		{"no genuine scores", ScoreDistribution{Impostor: []int64{1}}, 0, 0, true},
+		{"empty", ScoreDistribution{}, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eer, threshold, err := tt.dist.EqualErrorRate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("EqualErrorRate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if eer != tt.wantEER || threshold != tt.wantThreshold {
+				t.Errorf("EqualErrorRate() = %v at %v, want %v at %v", eer, threshold, tt.wantEER, tt.wantThreshold)
+			}
+		})
+	}
+}
+
+func TestDescribeEmptyClass(t *testing.T) {
+	// a single subject has no impostor scores
+	bio := testParams("finger")
+	bio.DbSize = 1
+	dist, err := SyntheticScoreDistribution(bio, NewSyntheticGenerator(rand.New(rand.NewSource(1)), DefaultSyntheticConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dist.Genuine) != 1 || len(dist.Impostor) != 0 {
+		t.Fatalf("got %v genuine and %v impostor scores, want 1 and 0", len(dist.Genuine), len(dist.Impostor))
+	}
+	out := dist.Describe()
+	if strings.Contains(out, "NaN") || !strings.Contains(out, "EER = n/a") {
+		t.Errorf("Describe() = %q, want n/a statistics", out)
+	}
+}
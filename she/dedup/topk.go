@@ -0,0 +1,120 @@
+package dedup
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// A candidate returned by top-k identification
+// Lower scores are better matches for all modalities, e.g., finger (Euclidean distance),
+// iris (100*HD - MATCH_THRESHOLD*maskSize) and face (FaceThreshold(D) - <x, y>).
+type Candidate struct {
+	UserID int
+	Score  int64
+}
+
+// Reconstructs the additive secret shares of the decrypted distances (mod T)
+// In Hyb-Janus, the RS adds a random share to the encrypted distance before sending
+// it to the BP, the BP share is the decryption result.
+func ReconstructShares(bpShare, rsShare []uint64, T uint64) ([]uint64, error) {
+	if len(bpShare) != len(rsShare) {
+		return nil, fmt.Errorf("ReconstructShares: mismatching share sizes %v != %v", len(bpShare), len(rsShare))
+	}
+	out := make([]uint64, len(bpShare))
+	for i := range out {
+		out[i] = (bpShare[i]%T + rsShare[i]%T) % T
+	}
+	return out, nil
+}
+
+// Maps the decrypted values in [0, T) to the score domain of the modality
+// For modalities with signed scores (e.g., iris and face), values larger than T/2
+// represent negative scores.
+func DecodeScores(bioType string, answer []uint64, T uint64) []int64 {
+	signed := false
+	if m, err := LookupModality(bioType); err == nil {
+		signed = m.SignedScore()
+	}
+	out := make([]int64, len(answer))
+	for i, v := range answer {
+		v %= T
+		if signed && v > T/2 {
+			out[i] = int64(v) - int64(T)
+		} else {
+			out[i] = int64(v)
+		}
+	}
+	return out
+}
+
+// Returns the k candidates with the lowest scores
+// Ties are broken deterministically by the smallest user id.
+func TopKCandidates(scores []int64, k int) []Candidate {
+	cands := make([]Candidate, len(scores))
+	for i := range scores {
+		cands[i] = Candidate{UserID: i, Score: scores[i]}
+	}
+	sort.SliceStable(cands, func(i, j int) bool {
+		if cands[i].Score != cands[j].Score {
+			return cands[i].Score < cands[j].Score
+		}
+		return cands[i].UserID < cands[j].UserID
+	})
+	if k > len(cands) {
+		k = len(cands)
+	}
+	if k < 0 {
+		k = 0
+	}
+	return cands[:k]
+}
+
+// BP side of the top-k identification
+// Decrypts the distances, reconstructs them with the RS shares (if any) and returns
+// the k closest users in the database.
+func BPprocessTopK(encDist []*rlwe.Ciphertext, rsShare []uint64, HE *HEHandler, params *JanusParams, k int) ([]Candidate, error) {
+	answer, err := BPprocessJanusIdReq(encDist, HE, params)
+	if err != nil {
+		return nil, fmt.Errorf("BPprocessTopK: %w", err)
+	}
+
+	if rsShare != nil {
+		answer, err = ReconstructShares(answer, rsShare, HE.Params.T())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return TopKCandidates(DecodeScores(params.BioType, answer, HE.Params.T()), k), nil
+}
+
+// Compute the top-k candidates using the plain database (ground truth)
+func (janus *Janus) TopKGroundTruth(query *PlainBio, k int) []Candidate {
+	scores := make([]int64, janus.Params.DbSize)
+	for i := range scores {
+		scores[i] = janus.Params.ComputeScore(query, janus.db[i])
+	}
+	return TopKCandidates(scores, k)
+}
+
+// Compares the decrypted answer with the ground truth modulo T
+// Returns an error describing the first mismatching users.
+func CheckAnswer(answer []uint64, groundTruth []int64, T uint64) error {
+	if len(answer) < len(groundTruth) {
+		return fmt.Errorf("CheckAnswer: got %v answers for %v users", len(answer), len(groundTruth))
+	}
+	mismatch := make([]int, 0)
+	for i := range groundTruth {
+		expected := ((groundTruth[i] % int64(T)) + int64(T)) % int64(T)
+		if answer[i]%T != uint64(expected) {
+			mismatch = append(mismatch, i)
+		}
+	}
+	if len(mismatch) > 0 {
+		i := mismatch[0]
+		return fmt.Errorf("CheckAnswer: %v/%v mismatching users, e.g., user %v: got %v expected %v (mod %v)",
+			len(mismatch), len(groundTruth), i, answer[i], groundTruth[i], T)
+	}
+	return nil
+}
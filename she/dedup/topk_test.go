@@ -0,0 +1,81 @@
+package dedup
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTopKCandidates(t *testing.T) {
+	tests := []struct {
+		name   string
+		scores []int64
+		k      int
+		want   []Candidate
+	}{
+		{"lowest scores", []int64{30, 10, 20, 40}, 2, []Candidate{{1, 10}, {2, 20}}},
+		{"ties by user id", []int64{5, 3, 5, 3, 5}, 4, []Candidate{{1, 3}, {3, 3}, {0, 5}, {2, 5}}},
+		{"negative scores", []int64{7, -2, 0, -9}, 3, []Candidate{{3, -9}, {1, -2}, {2, 0}}},
+		{"k larger than DB", []int64{2, 1}, 5, []Candidate{{1, 1}, {0, 2}}},
+		{"k zero", []int64{2, 1}, 0, []Candidate{}},
+		{"k negative", []int64{2, 1}, -1, []Candidate{}},
+		{"empty DB", []int64{}, 3, []Candidate{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := TopKCandidates(tt.scores, tt.k)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TopKCandidates(%v, %v) = %v, want %v", tt.scores, tt.k, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconstructShares(t *testing.T) {
+	const T = 17
+	tests := []struct {
+		name    string
+		bp, rs  []uint64
+		want    []uint64
+		wantErr bool
+	}{
+		{"no wrap-around", []uint64{1, 2, 3}, []uint64{4, 5, 6}, []uint64{5, 7, 9}, false},
+		{"wrap-around", []uint64{16, 10}, []uint64{1, 15}, []uint64{0, 8}, false},
+		{"shares larger than T", []uint64{T + 1, 3 * T}, []uint64{2 * T, T + 5}, []uint64{1, 5}, false},
+		{"mismatching sizes", []uint64{1, 2}, []uint64{1}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReconstructShares(tt.bp, tt.rs, T)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReconstructShares error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReconstructShares(%v, %v) = %v, want %v", tt.bp, tt.rs, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeScores(t *testing.T) {
+	const T = 101
+	tests := []struct {
+		name    string
+		bioType string
+		answer  []uint64
+		want    []int64
+	}{
+		{"finger is unsigned", "finger", []uint64{0, 50, 51, 100}, []int64{0, 50, 51, 100}},
+		{"iris negative scores", "iris", []uint64{0, 50, 51, 100}, []int64{0, 50, -50, -1}},
+		{"face negative scores", "face", []uint64{1, T - 3}, []int64{1, -3}},
+		{"values reduced mod T", "iris", []uint64{T + 2, 2*T - 1}, []int64{2, -1}},
+		{"unknown modality is unsigned", "unknown", []uint64{100}, []int64{100}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := DecodeScores(tt.bioType, tt.answer, T)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DecodeScores(%v, %v) = %v, want %v", tt.bioType, tt.answer, got, tt.want)
+			}
+		})
+	}
+}
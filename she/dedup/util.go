@@ -1,23 +1,31 @@
 package dedup
 
 import (
+	"encoding/binary"
 	"fmt"
-	"math/rand"
+	"math/bits"
 	"os"
 
 	"github.com/tuneinsight/lattigo/v4/bfv"
 	"github.com/tuneinsight/lattigo/v4/rlwe"
+	"github.com/tuneinsight/lattigo/v4/utils"
 )
 
 type HEHandler struct {
-	Params    bfv.Parameters
-	Encoder   bfv.Encoder
+	Scheme    string         // SCHEME_BFV (default) or SCHEME_BGV, must be set before the key generation
+	Params    bfv.Parameters // ring, modulus and plaintext modulus (shared by BFV and BGV)
+	Encoder   SHEEncoder
 	Encryptor rlwe.Encryptor
 	Decryptor rlwe.Decryptor
-	Evaluator bfv.Evaluator
+	Evaluator SHEEvaluator
+
+	SecretKey *rlwe.SecretKey // only held by the biometric provider
+	PublicKey *rlwe.PublicKey
+	EvalKey   rlwe.EvaluationKey
+	Epoch     int // key epoch, incremented at each key rotation (see RotateKey)
 }
 
-func (he *HEHandler) KeyGen(params bfv.Parameters) {
+func (he *HEHandler) KeyGen(params bfv.Parameters) error {
 	he.Params = params
 	kgen := bfv.NewKeyGenerator(params)
 	sk, pk := kgen.GenKeyPair()
@@ -25,20 +33,48 @@ func (he *HEHandler) KeyGen(params bfv.Parameters) {
 		Rlk:  kgen.GenRelinearizationKey(sk, 2),
 		Rtks: kgen.GenRotationKeysForInnerSum(sk),
 	}
+	return he.SetKeys(params, sk, pk, evk)
+}
+
+// Generates the keys with only the rotation keys used by the identification of $bio
+// (see JanusParams.GaloisElements), instead of all the power-of-two rotations.
+func (he *HEHandler) KeyGenForJanus(params bfv.Parameters, bio *JanusParams) error {
+	he.Params = params
+	kgen := bfv.NewKeyGenerator(params)
+	sk, pk := kgen.GenKeyPair()
+	evk := rlwe.EvaluationKey{
+		Rlk:  kgen.GenRelinearizationKey(sk, 2),
+		Rtks: kgen.GenRotationKeys(bio.GaloisElements(params), sk),
+	}
+	return he.SetKeys(params, sk, pk, evk)
+}
+
+// Instantiates the handler from existing keys, $sk may be nil for a public handler
+// Fails with ErrParamMismatch if the scheme of the handler is not supported.
+func (he *HEHandler) SetKeys(params bfv.Parameters, sk *rlwe.SecretKey, pk *rlwe.PublicKey, evk rlwe.EvaluationKey) error {
+	he.Params = params
+	he.SecretKey = sk
+	he.PublicKey = pk
+	he.EvalKey = evk
 
-	he.Encoder = bfv.NewEncoder(params)
-	he.Decryptor = bfv.NewDecryptor(params, sk)
-	he.Encryptor = bfv.NewEncryptor(params, pk)
-	he.Evaluator = bfv.NewEvaluator(params, evk)
+	if err := he.setBackend(params, sk, pk, evk); err != nil {
+		return fmt.Errorf("SetKeys: %w", err)
+	}
+	return nil
 }
 
 func (priv *HEHandler) GetPublicHandler() *HEHandler {
 	return &HEHandler{
+		Scheme:    priv.Scheme,
 		Params:    priv.Params,
 		Encoder:   priv.Encoder,
 		Encryptor: priv.Encryptor,
 		Decryptor: nil,
 		Evaluator: priv.Evaluator,
+		SecretKey: nil,
+		PublicKey: priv.PublicKey,
+		EvalKey:   priv.EvalKey,
+		Epoch:     priv.Epoch,
 	}
 }
 
@@ -69,6 +105,27 @@ func DistEuclidean(a, b []int64) int64 {
 	return dist
 }
 
+// Squared Euclidean distance with per-feature weights
+func DistWeightedEuclidean(a, b, weights []int64) int64 {
+	dist := int64(0)
+	for i := range a {
+		dist += weights[i] * (a[i] - b[i]) * (a[i] - b[i])
+	}
+	return dist
+}
+
+func DistManhattan(a, b []int64) int64 {
+	dist := int64(0)
+	for i := range a {
+		if a[i] > b[i] {
+			dist += a[i] - b[i]
+		} else {
+			dist += b[i] - a[i]
+		}
+	}
+	return dist
+}
+
 func IsPowerOf2(a int) bool {
 	return (a & (a - 1)) == 0
 }
@@ -83,7 +140,7 @@ func NextPow2(a int) int {
 
 func ExtendedRotate(
 	params *bfv.Parameters,
-	evaluator bfv.Evaluator,
+	evaluator SHEEvaluator,
 	rot int,
 	ctx *rlwe.Ciphertext,
 ) {
@@ -99,32 +156,77 @@ func ExtendedRotate(
 	}
 }
 
+// Returns $n values uniform in [0, T) drawn from a cryptographically secure PRNG
+// The slot randomizers hide data from the BP and must not use the (seeded) math/rand
+// generators of the test data.
+func secureUniformSlots(n int, T uint64) []uint64 {
+	prng, err := utils.NewPRNG()
+	if err != nil {
+		panic(err)
+	}
+	mask := uint64(1)<<bits.Len64(T-1) - 1
+	data := make([]uint64, n)
+	buf := make([]byte, 8*n)
+	for filled := 0; filled < n; {
+		prng.Read(buf)
+		// rejection sampling, at least half of the draws are accepted
+		for j := 0; j+8 <= len(buf) && filled < n; j += 8 {
+			if v := binary.LittleEndian.Uint64(buf[j:]) & mask; v < T {
+				data[filled] = v
+				filled++
+			}
+		}
+	}
+	return data
+}
+
 // Create a random ptx to randomize (additive) all SIMD slots that are not
 // in the form of k*dataStep.
 // This prevent leakage from internal slots in inner sum.
 func InternalSlotRandomizer(dataStep int, HE *HEHandler) *rlwe.Plaintext {
-	data := make([]uint64, HE.Params.N())
-	for i := 0; i < int(len(data)); i++ {
-		// Warning: USE CRYPTO SECURE RANDOMNESS
-		if (i % dataStep) == 0 {
-			data[i] = 0
-		} else {
-			data[i] = rand.Uint64() % HE.Params.T()
-		}
+	data := secureUniformSlots(HE.Params.N(), HE.Params.T())
+	for i := 0; i < int(len(data)); i += dataStep {
+		data[i] = 0
 	}
 
 	return HE.Encoder.EncodeNew(data, HE.Params.MaxLevel())
 }
 
-func AppendLine(filepath string, s string) {
+// Create a random ptx to randomize (additive) all SIMD slots except the slot
+// holding the sum of the $recIdx'th record ($recIdx*dataStep).
+// This hides the distances of all other records of the strip in 1:1 verification.
+// Unlike a plaintext multiplication by a selection mask, it does not consume noise budget.
+func RecordSlotRandomizer(recIdx int, dataStep int, HE *HEHandler) *rlwe.Plaintext {
+	data := secureUniformSlots(HE.Params.N(), HE.Params.T())
+	data[recIdx*dataStep] = 0
+
+	return HE.Encoder.EncodeNew(data, HE.Params.MaxLevel())
+}
+
+// Appends $s to the file (e.g., the performance log), the file is created if needed
+func AppendLine(filepath string, s string) error {
 	f, err := os.OpenFile(filepath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		fmt.Print("***** Error opening performance log")
+		return fmt.Errorf("AppendLine: %w", err)
 	}
-	defer f.Close()
 	if _, err := f.WriteString(s); err != nil {
-		fmt.Print("***** Error writing in the performance log")
+		f.Close()
+		return fmt.Errorf("AppendLine: %w", err)
+	}
+	return f.Close()
+}
+
+// Drops the ciphertexts to $level (modulus switching) to reduce their size
+// Ciphertexts already at a lower level are not modified.
+func DropLevel(HE *HEHandler, ctxs []*rlwe.Ciphertext, level int) error {
+	for _, ctx := range ctxs {
+		if ctx.Level() > level {
+			if err := HE.Evaluator.ModSwitchTo(ctx, level); err != nil {
+				return fmt.Errorf("DropLevel: %w", err)
+			}
+		}
 	}
+	return nil
 }
 
 func MarshalCtxArray(ctxs []*rlwe.Ciphertext) ([][]byte, error) {